@@ -0,0 +1,44 @@
+package fastudp
+
+import "sync"
+
+// bufferPool is a bounded free list of equally sized buffers, it doesn't allocate
+// on put like sync.Pool does for slices.
+type bufferPool struct {
+	size int
+	free [][]byte
+	sync.Mutex
+}
+
+func newBufferPool(size, capacity int) *bufferPool {
+	return &bufferPool{
+		size: size,
+		free: make([][]byte, 0, capacity),
+	}
+}
+
+func (pool *bufferPool) get() []byte {
+	pool.Lock()
+	if n := len(pool.free); n > 0 {
+		buf := pool.free[n-1]
+		pool.free[n-1] = nil
+		pool.free = pool.free[:n-1]
+		pool.Unlock()
+		return buf
+	}
+	pool.Unlock()
+
+	return make([]byte, pool.size)
+}
+
+func (pool *bufferPool) put(buf []byte) {
+	if cap(buf) < pool.size {
+		return
+	}
+
+	pool.Lock()
+	if len(pool.free) < cap(pool.free) {
+		pool.free = append(pool.free, buf[:pool.size])
+	}
+	pool.Unlock()
+}
@@ -0,0 +1,6 @@
+package fastudp
+
+import "errors"
+
+// ErrClientClosed is returned by the writes of a Client which was shut down.
+var ErrClientClosed = errors.New("client closed")
@@ -0,0 +1,114 @@
+//go:build linux
+// +build linux
+
+package fastudp
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/shaoyuan1943/fastudp/netudp"
+)
+
+// Client is a socket connected to one peer and served by an event-loop like the
+// ones of Server, datagrams from the peer are delivered to the handler.
+type Client struct {
+	svr    *Server
+	loop   *eventLoop
+	remote netip.AddrPort
+}
+
+// NewUDPClient connects to addr, only the options of config which make sense for
+// a single socket are used: ListenerN and LoadBalancing are ignored.
+func NewUDPClient(network, addr string, handler EventHandler, config Config) (*Client, error) {
+	if !netudp.IsUDP(network) {
+		return nil, fmt.Errorf("unknown network: %v", network)
+	}
+
+	config.ListenerN = 1
+	svr, err := newServer(handler, config)
+	if err != nil {
+		return nil, err
+	}
+
+	sock, err := dial(network, addr, svr.config.Socket)
+	if err != nil {
+		svr.Shutdown(context.Background())
+		return nil, err
+	}
+
+	ln := newListener(svr, network)
+	ln.addr = sock.local
+	ln.opts = sock.opts
+	loop, err := svr.serve(ln, sock, svr.config.cpu(0))
+	if err == nil {
+		err = svr.addListener(ln)
+	}
+
+	if err != nil {
+		svr.Shutdown(context.Background())
+		return nil, err
+	}
+
+	return &Client{svr: svr, loop: loop, remote: sock.remote}, nil
+}
+
+// LocalAddr returns the address the client sends from.
+func (c *Client) LocalAddr() netip.AddrPort {
+	return c.loop.ln.addr
+}
+
+// SocketOptions returns the options of the socket as the kernel applied them.
+func (c *Client) SocketOptions() netudp.SocketOptions {
+	return c.loop.ln.opts
+}
+
+// RemoteAddr returns the peer of the client.
+func (c *Client) RemoteAddr() netip.AddrPort {
+	return c.remote
+}
+
+// PathMTU returns the MTU the kernel knows for the path to the peer.
+func (c *Client) PathMTU() (int, error) {
+	return c.loop.pathMTU()
+}
+
+// Write sends data to the peer, it's queued when the socket is busy.
+func (c *Client) Write(data []byte) (int, error) {
+	if c.svr.closed.Load().(bool) {
+		return 0, ErrClientClosed
+	}
+
+	return c.loop.Write(data)
+}
+
+// WriteBatch sends msgs to the peer with as few sendmmsg calls as possible,
+// the address of every message is ignored.
+func (c *Client) WriteBatch(msgs []Message) (int, error) {
+	if c.svr.closed.Load().(bool) {
+		return 0, ErrClientClosed
+	}
+
+	for i := range msgs {
+		msgs[i].Addr = nil
+		msgs[i].AddrPort = c.remote
+	}
+
+	return c.loop.WriteBatch(msgs)
+}
+
+// Shutdown works like Server.Shutdown.
+func (c *Client) Shutdown(ctx context.Context) error {
+	return c.svr.Shutdown(ctx)
+}
+
+// Serve works like Server.Serve.
+func (c *Client) Serve(ctx context.Context) error {
+	return c.svr.Serve(ctx)
+}
+
+// Stats returns a snapshot of the client counters.
+func (c *Client) Stats() Stats {
+	return c.svr.Stats()
+}
@@ -0,0 +1,101 @@
+package fastudp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// replyHandler hands the data of every datagram to replies.
+type replyHandler struct {
+	replies chan string
+}
+
+func (h *replyHandler) OnReaded([]byte, *net.UDPAddr) {}
+func (h *replyHandler) OnError(err error)             {}
+
+func (h *replyHandler) OnReadedAddrPort(data []byte, addr netip.AddrPort, w Writer) {
+	h.replies <- string(data)
+}
+
+func TestClient(t *testing.T) {
+	for _, tt := range []struct {
+		network string
+		ip      net.IP
+	}{
+		{"udp4", net.IPv4(127, 0, 0, 1)},
+		{"udp6", net.IPv6loopback},
+	} {
+		t.Run(tt.network, func(t *testing.T) {
+			peer, err := net.ListenUDP(tt.network, &net.UDPAddr{IP: tt.ip})
+			if err != nil {
+				t.Skipf("listen %v: %v", tt.network, err)
+			}
+			defer peer.Close()
+
+			h := &replyHandler{replies: make(chan string, 1)}
+			addr := peer.LocalAddr().(*net.UDPAddr).AddrPort()
+			c, err := NewUDPClient(tt.network, addr.String(), h, DefaultConfig())
+			if err != nil {
+				t.Fatalf("NewUDPClient: %v", err)
+			}
+			defer c.Shutdown(context.Background())
+
+			if c.RemoteAddr() != addr {
+				t.Fatalf("RemoteAddr() = %v, want %v", c.RemoteAddr(), addr)
+			}
+
+			if _, err := c.Write([]byte("ping")); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+
+			buf := make([]byte, 16)
+			peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, from, err := peer.ReadFromUDPAddrPort(buf)
+			if err != nil || string(buf[:n]) != "ping" {
+				t.Fatalf("peer read %q, %v, want %q", buf[:n], err, "ping")
+			}
+
+			if from.Port() != c.LocalAddr().Port() {
+				t.Fatalf("datagram from %v, want the port of %v", from, c.LocalAddr())
+			}
+
+			if _, err := peer.WriteToUDPAddrPort([]byte("pong"), from); err != nil {
+				t.Fatalf("WriteToUDPAddrPort: %v", err)
+			}
+
+			select {
+			case reply := <-h.replies:
+				if reply != "pong" {
+					t.Fatalf("reply %q, want %q", reply, "pong")
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("no reply was delivered")
+			}
+		})
+	}
+}
+
+func TestClientClosed(t *testing.T) {
+	peer := listenPeer(t)
+	c, err := NewUDPClient("udp4", peer.LocalAddr().String(), &replyHandler{replies: make(chan string, 1)}, DefaultConfig())
+	if err != nil {
+		t.Fatalf("NewUDPClient: %v", err)
+	}
+
+	if err := c.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if _, err := c.Write([]byte("ping")); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("Write after Shutdown = %v, want ErrClientClosed", err)
+	}
+
+	msgs := []Message{{Data: []byte("ping")}}
+	if _, err := c.WriteBatch(msgs); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("WriteBatch after Shutdown = %v, want ErrClientClosed", err)
+	}
+}
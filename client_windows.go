@@ -0,0 +1,111 @@
+package fastudp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/shaoyuan1943/fastudp/netudp"
+)
+
+// Client is a socket connected to one peer, datagrams from the peer are
+// delivered to the handler.
+type Client struct {
+	svr    *Server
+	ln     *Listener
+	remote netip.AddrPort
+}
+
+// NewUDPClient connects to addr, only config.MTU, config.Dispatch and the options of
+// config.Socket netudp.DialUDP knows are used on windows.
+func NewUDPClient(network, addr string, handler EventHandler, config Config) (*Client, error) {
+	if !netudp.IsUDP(network) {
+		return nil, fmt.Errorf("unknown network: %v", network)
+	}
+
+	svr, err := newServer(handler, config)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := netudp.DialUDP(network, addr, svr.config.Socket)
+	if err == nil {
+		ln := newListener(svr, network, conn)
+		if err = ln.readSocketOptions(); err == nil {
+			if err = svr.serve(ln); err == nil {
+				return &Client{svr: svr, ln: ln, remote: netudp.AddrPortOf(conn.RemoteAddr().(*net.UDPAddr))}, nil
+			}
+		}
+		conn.Close()
+	}
+
+	svr.Shutdown(context.Background())
+	return nil, fmt.Errorf("dial udp: %v", err)
+}
+
+// LocalAddr returns the address the client sends from.
+func (c *Client) LocalAddr() netip.AddrPort {
+	return c.ln.addr
+}
+
+// SocketOptions returns the options of the socket as windows applied them.
+func (c *Client) SocketOptions() netudp.SocketOptions {
+	return c.ln.opts
+}
+
+// RemoteAddr returns the peer of the client.
+func (c *Client) RemoteAddr() netip.AddrPort {
+	return c.remote
+}
+
+// PathMTU isn't supported on windows.
+func (c *Client) PathMTU() (int, error) {
+	return 0, fmt.Errorf("path MTU not supported on windows")
+}
+
+// Write sends data to the peer.
+func (c *Client) Write(data []byte) (int, error) {
+	if c.svr.IsClosed() {
+		return 0, ErrClientClosed
+	}
+
+	return c.ln.conn.Write(data)
+}
+
+// WriteBatch writes msgs to the peer one by one, the address of every message is ignored.
+func (c *Client) WriteBatch(msgs []Message) (int, error) {
+	var firstErr error
+	accepted := 0
+	for i := range msgs {
+		if _, err := c.Write(msgs[i].Data); err != nil {
+			msgs[i].fail(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		msgs[i].Status = WriteSent
+		msgs[i].Err = nil
+		msgs[i].sent()
+		accepted++
+	}
+
+	return accepted, firstErr
+}
+
+// Shutdown works like Server.Shutdown.
+func (c *Client) Shutdown(ctx context.Context) error {
+	return c.svr.Shutdown(ctx)
+}
+
+// Serve works like Server.Serve.
+func (c *Client) Serve(ctx context.Context) error {
+	return c.svr.Serve(ctx)
+}
+
+// Stats returns a snapshot of the client counters.
+func (c *Client) Stats() Stats {
+	return c.svr.Stats()
+}
@@ -0,0 +1,415 @@
+package fastudp
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/shaoyuan1943/fastudp/netudp"
+)
+
+const (
+	// DefaultMTU is the default receive buffer size of every datagram.
+	DefaultMTU = 1500
+	// MaxMTU is the largest payload a UDP datagram can carry over IPv4.
+	MaxMTU = 65507
+	// DefaultBatchSize is the default number of messages per recvmmsg/sendmmsg.
+	DefaultBatchSize = 128
+	// MaxBatchSize is the kernel limit of messages per recvmmsg/sendmmsg (UIO_MAXIOV).
+	MaxBatchSize = 1024
+	// DefaultReadEventQueueSize is the default depth of the read notify queue of an event-loop.
+	DefaultReadEventQueueSize = 128
+	// DefaultWriteQueueSize is the default number of pending datagrams an event-loop keeps
+	// while the socket is not writable.
+	DefaultWriteQueueSize = 4096
+	// DefaultPeerTableSize is the default number of peers remembered by PeerAffinity.
+	DefaultPeerTableSize = 65536
+	// DefaultDispatchQueueSize is the default depth of each worker queue.
+	DefaultDispatchQueueSize = 1024
+	// DefaultShutdownTimeout is the default time Serve gives Shutdown to flush the write queues.
+	DefaultShutdownTimeout = 5 * time.Second
+)
+
+// LoadBalancing selects the event-loop which sends a datagram written by Server.WriteTo.
+type LoadBalancing int
+
+const (
+	// PeerAffinity sends through the event-loop whose socket last received from the peer,
+	// unknown peers fall back to PeerHash.
+	PeerAffinity LoadBalancing = iota
+	// RoundRobin rotates over the event-loops.
+	RoundRobin
+	// LeastQueued picks the event-loop with the shortest write queue.
+	LeastQueued
+	// PeerHash picks the event-loop by a stable hash of the peer address.
+	PeerHash
+)
+
+func (lb LoadBalancing) String() string {
+	switch lb {
+	case PeerAffinity:
+		return "peer-affinity"
+	case RoundRobin:
+		return "round-robin"
+	case LeastQueued:
+		return "least-queued"
+	case PeerHash:
+		return "peer-hash"
+	}
+
+	return fmt.Sprintf("LoadBalancing(%d)", int(lb))
+}
+
+// DispatchMode selects where the handler runs.
+type DispatchMode int
+
+const (
+	// DispatchInline runs the handler on the reader goroutine of the event-loop,
+	// a slow handler stalls the socket.
+	DispatchInline DispatchMode = iota
+	// DispatchWorkerPool runs the handler on a bounded pool of workers,
+	// datagrams are processed in parallel without any order.
+	DispatchWorkerPool
+	// DispatchPerPeer runs the handler on a bounded pool of workers, datagrams of
+	// the same peer are always processed by the same worker in arrival order.
+	DispatchPerPeer
+)
+
+func (mode DispatchMode) String() string {
+	switch mode {
+	case DispatchInline:
+		return "inline"
+	case DispatchWorkerPool:
+		return "worker-pool"
+	case DispatchPerPeer:
+		return "per-peer"
+	}
+
+	return fmt.Sprintf("DispatchMode(%d)", int(mode))
+}
+
+// QueueFullPolicy decides what happens to a datagram when its worker queue is full.
+type QueueFullPolicy int
+
+const (
+	// QueueFullBlock makes the reader wait, the kernel drops once the socket buffer is full.
+	QueueFullBlock QueueFullPolicy = iota
+	// QueueFullDropNewest drops the datagram being dispatched.
+	QueueFullDropNewest
+	// QueueFullDropOldest drops the oldest queued datagram to make room.
+	QueueFullDropOldest
+)
+
+func (policy QueueFullPolicy) String() string {
+	switch policy {
+	case QueueFullBlock:
+		return "block"
+	case QueueFullDropNewest:
+		return "drop-newest"
+	case QueueFullDropOldest:
+		return "drop-oldest"
+	}
+
+	return fmt.Sprintf("QueueFullPolicy(%d)", int(policy))
+}
+
+// DispatchConfig configures how datagrams are handed to the handler.
+type DispatchConfig struct {
+	Mode DispatchMode
+	// Workers is the number of handler goroutines, defaults to runtime.NumCPU().
+	Workers int
+	// QueueSize is the depth of each worker queue (of the shared queue for
+	// DispatchWorkerPool), defaults to DefaultDispatchQueueSize.
+	QueueSize       int
+	QueueFullPolicy QueueFullPolicy
+}
+
+// SteeringPolicy selects the event-loop of a Listener which receives a datagram.
+type SteeringPolicy int
+
+const (
+	// SteerByHash leaves it to the kernel, which hashes the addresses of the datagram.
+	SteerByHash SteeringPolicy = iota
+	// SteerByCPU delivers the datagrams the CPU c received to the event-loop
+	// c%ListenerN, every event-loop serves the flows of its CPU.
+	SteerByCPU
+	// SteerByPayload picks the event-loop by bytes of the payload, such as a
+	// connection ID, so that a session keeps its event-loop when the address of
+	// the peer changes.
+	SteerByPayload
+	// SteerByProgram runs a classic BPF program of its own.
+	SteerByProgram
+)
+
+func (policy SteeringPolicy) String() string {
+	switch policy {
+	case SteerByHash:
+		return "hash"
+	case SteerByCPU:
+		return "cpu"
+	case SteerByPayload:
+		return "payload"
+	case SteerByProgram:
+		return "program"
+	}
+
+	return fmt.Sprintf("SteeringPolicy(%d)", int(policy))
+}
+
+// SteeringConfig configures how the kernel spreads the datagrams of a Listener
+// over its sockets with SO_ATTACH_REUSEPORT_CBPF, policies other than SteerByHash
+// need Socket.ReusePort. Ignored on windows.
+type SteeringConfig struct {
+	Policy SteeringPolicy
+	// PayloadOffset and PayloadSize locate the bytes SteerByPayload reads, they
+	// are an unsigned integer in network byte order of 1, 2 or 4 bytes. Datagrams
+	// too short go to the first event-loop.
+	PayloadOffset int
+	PayloadSize   int
+	// Program is the program of SteerByProgram, see netudp.AttachReusePortProgram.
+	// It returns the index of the event-loop in the order they were created.
+	Program []netudp.BPFInstruction
+}
+
+// program returns the program of the policy for n sockets, nil for SteerByHash.
+func (steering *SteeringConfig) program(n int) ([]netudp.BPFInstruction, error) {
+	switch steering.Policy {
+	case SteerByCPU:
+		return netudp.SteerByCPU(n), nil
+	case SteerByPayload:
+		return netudp.SteerByPayload(steering.PayloadOffset, steering.PayloadSize, n)
+	case SteerByProgram:
+		return steering.Program, nil
+	}
+
+	return nil, nil
+}
+
+// Config is the per-server configuration, a zero value field selects its default.
+type Config struct {
+	// ListenerN is the number of sockets (and event-loops) serving the address,
+	// more than one requires Socket.ReusePort. Defaults to runtime.NumCPU()
+	// with ReusePort, 1 otherwise.
+	ListenerN int
+	// MTU is the largest datagram which can be read or written, defaults to DefaultMTU.
+	MTU int
+	// ReadBatchSize is the number of datagrams read by one recvmmsg.
+	ReadBatchSize int
+	// WriteBatchSize is the number of datagrams written by one sendmmsg.
+	WriteBatchSize int
+	// ReadEventQueueSize is the depth of the queue between poller and reader of an event-loop.
+	ReadEventQueueSize int
+	// WriteQueueSize is the max number of datagrams waiting for the socket to be writable,
+	// a write is rejected when the queue is full.
+	WriteQueueSize int
+	// LoadBalancing selects the event-loop used by Server.WriteTo, defaults to PeerAffinity.
+	LoadBalancing LoadBalancing
+	// PeerTableSize is the number of peers PeerAffinity remembers, the table is
+	// reset when it's full.
+	PeerTableSize int
+	// Dispatch selects where the handler runs, defaults to DispatchInline.
+	Dispatch DispatchConfig
+	// Steering selects the event-loop of a Listener which receives a datagram,
+	// defaults to SteerByHash.
+	Steering SteeringConfig
+	// ShutdownTimeout bounds the shutdown started by Serve when its context is done.
+	ShutdownTimeout time.Duration
+	// LockOSThread wires the poller goroutine of every event-loop to its own OS thread.
+	LockOSThread bool
+	// CPUs pins the event-loop i of every Listener to CPUs[i%len(CPUs)]: its poller
+	// and reader goroutines run on OS threads bound to the CPU and its socket gets
+	// SO_INCOMING_CPU. With CPUs 0 to ListenerN-1 and SteerByCPU the datagrams are
+	// read on the CPU which received them. Ignored on windows.
+	CPUs []int
+	// GSO coalesces consecutive datagrams to the same peer of WriteBatch and of
+	// the write queues into UDP_SEGMENT sends, it's silently turned off on a
+	// socket whose kernel or device can't segment. Ignored on windows.
+	GSO bool
+	// GRO lets the kernel coalesce the datagrams of a flow into one buffer per
+	// read slot, they are split back before being delivered. Every slot of
+	// ReadBatchSize grows to 64KiB. Ignored when unsupported and on windows.
+	GRO bool
+	// PacketInfo reports the local address and the interface every datagram
+	// arrived on through Packet.LocalAddr and Packet.IfIndex, so that replies
+	// can be sent from the address the peer targeted. Ignored on windows.
+	PacketInfo bool
+	// ZeroCopy sends the messages of Writer.WriteMsg and Writer.WriteBatch which
+	// have a Done callback with MSG_ZEROCOPY: the kernel reads their data in
+	// place and Done is called when it's finished, which is worth it for large
+	// datagrams. Callbacks pending when the socket is closed aren't called. It's
+	// silently turned off when unsupported and ignored on windows.
+	ZeroCopy bool
+	// IOURing receives and sends through io_uring: a multishot recvmsg fills a
+	// ring of buffers, which saves the recvmmsg and the epoll_wait of every batch,
+	// and the batches are sent as linked sendmsg. Handlers are called as with
+	// epoll, which is used when the kernel has no multishot recvmsg, before 6.0,
+	// or io_uring is disabled. Ignored on windows.
+	IOURing bool
+	// Socket holds the options applied to every listening socket, the values the
+	// kernel applied are reported by Listener.SocketOptions. Only ReadBuffer,
+	// WriteBuffer and Control are used on windows.
+	Socket netudp.SocketOptions
+}
+
+// cpu returns the CPU of the event-loop i of a Listener, -1 when it isn't pinned.
+func (config *Config) cpu(i int) int {
+	if len(config.CPUs) == 0 {
+		return -1
+	}
+
+	return config.CPUs[i%len(config.CPUs)]
+}
+
+// DefaultConfig returns a Config with all defaults filled in.
+func DefaultConfig() Config {
+	config := Config{}
+	config.setDefaults()
+	return config
+}
+
+func (config *Config) setDefaults() {
+	if config.ListenerN == 0 {
+		if config.Socket.ReusePort {
+			config.ListenerN = runtime.NumCPU()
+		} else {
+			config.ListenerN = 1
+		}
+	}
+
+	if config.MTU == 0 {
+		config.MTU = DefaultMTU
+	}
+
+	if config.ReadBatchSize == 0 {
+		config.ReadBatchSize = DefaultBatchSize
+	}
+
+	if config.WriteBatchSize == 0 {
+		config.WriteBatchSize = DefaultBatchSize
+	}
+
+	if config.ReadEventQueueSize == 0 {
+		config.ReadEventQueueSize = DefaultReadEventQueueSize
+	}
+
+	if config.WriteQueueSize == 0 {
+		config.WriteQueueSize = DefaultWriteQueueSize
+	}
+
+	if config.PeerTableSize == 0 {
+		config.PeerTableSize = DefaultPeerTableSize
+	}
+
+	if config.Dispatch.Workers == 0 {
+		config.Dispatch.Workers = runtime.NumCPU()
+	}
+
+	if config.Dispatch.QueueSize == 0 {
+		config.Dispatch.QueueSize = DefaultDispatchQueueSize
+	}
+
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = DefaultShutdownTimeout
+	}
+}
+
+// validate fills defaults and checks every field, config must not be used when it fails.
+func (config *Config) validate() error {
+	config.setDefaults()
+
+	if config.ListenerN < 0 {
+		return fmt.Errorf("config: ListenerN must not be negative, got %v", config.ListenerN)
+	}
+
+	if config.ListenerN > 1 && !config.Socket.ReusePort {
+		return fmt.Errorf("config: ListenerN %v requires Socket.ReusePort", config.ListenerN)
+	}
+
+	if config.MTU < 0 || config.MTU > MaxMTU {
+		return fmt.Errorf("config: MTU must be in [1, %v], got %v", MaxMTU, config.MTU)
+	}
+
+	if config.ReadBatchSize < 0 || config.ReadBatchSize > MaxBatchSize {
+		return fmt.Errorf("config: ReadBatchSize must be in [1, %v], got %v", MaxBatchSize, config.ReadBatchSize)
+	}
+
+	if config.WriteBatchSize < 0 || config.WriteBatchSize > MaxBatchSize {
+		return fmt.Errorf("config: WriteBatchSize must be in [1, %v], got %v", MaxBatchSize, config.WriteBatchSize)
+	}
+
+	if config.ReadEventQueueSize < 0 {
+		return fmt.Errorf("config: ReadEventQueueSize must not be negative, got %v", config.ReadEventQueueSize)
+	}
+
+	if config.WriteQueueSize < 0 {
+		return fmt.Errorf("config: WriteQueueSize must not be negative, got %v", config.WriteQueueSize)
+	}
+
+	switch config.LoadBalancing {
+	case PeerAffinity, RoundRobin, LeastQueued, PeerHash:
+	default:
+		return fmt.Errorf("config: unknown LoadBalancing %v", config.LoadBalancing)
+	}
+
+	if config.PeerTableSize < 0 {
+		return fmt.Errorf("config: PeerTableSize must not be negative, got %v", config.PeerTableSize)
+	}
+
+	switch config.Dispatch.Mode {
+	case DispatchInline, DispatchWorkerPool, DispatchPerPeer:
+	default:
+		return fmt.Errorf("config: unknown Dispatch.Mode %v", config.Dispatch.Mode)
+	}
+
+	switch config.Dispatch.QueueFullPolicy {
+	case QueueFullBlock, QueueFullDropNewest, QueueFullDropOldest:
+	default:
+		return fmt.Errorf("config: unknown Dispatch.QueueFullPolicy %v", config.Dispatch.QueueFullPolicy)
+	}
+
+	if config.Dispatch.Workers < 0 {
+		return fmt.Errorf("config: Dispatch.Workers must not be negative, got %v", config.Dispatch.Workers)
+	}
+
+	if config.Dispatch.QueueSize < 0 {
+		return fmt.Errorf("config: Dispatch.QueueSize must not be negative, got %v", config.Dispatch.QueueSize)
+	}
+
+	switch config.Steering.Policy {
+	case SteerByHash:
+	case SteerByCPU, SteerByPayload, SteerByProgram:
+		if !config.Socket.ReusePort {
+			return fmt.Errorf("config: Steering.Policy %v requires Socket.ReusePort", config.Steering.Policy)
+		}
+
+		if config.Steering.Policy == SteerByProgram && len(config.Steering.Program) == 0 {
+			return fmt.Errorf("config: Steering.Policy %v requires Steering.Program", config.Steering.Policy)
+		}
+
+		if _, err := config.Steering.program(config.ListenerN); err != nil {
+			return fmt.Errorf("config: %v", err)
+		}
+	default:
+		return fmt.Errorf("config: unknown Steering.Policy %v", config.Steering.Policy)
+	}
+
+	for _, cpu := range config.CPUs {
+		if cpu < 0 {
+			return fmt.Errorf("config: CPUs must not be negative, got %v", cpu)
+		}
+	}
+
+	if config.ShutdownTimeout < 0 {
+		return fmt.Errorf("config: ShutdownTimeout must not be negative, got %v", config.ShutdownTimeout)
+	}
+
+	if config.Socket.ReadBuffer < 0 {
+		return fmt.Errorf("config: Socket.ReadBuffer must not be negative, got %v", config.Socket.ReadBuffer)
+	}
+
+	if config.Socket.WriteBuffer < 0 {
+		return fmt.Errorf("config: Socket.WriteBuffer must not be negative, got %v", config.Socket.WriteBuffer)
+	}
+
+	return nil
+}
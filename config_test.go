@@ -0,0 +1,112 @@
+package fastudp
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/shaoyuan1943/fastudp/netudp"
+)
+
+func TestConfigSetDefaults(t *testing.T) {
+	config := DefaultConfig()
+	for _, c := range []struct {
+		name      string
+		got, want int
+	}{
+		{"ListenerN", config.ListenerN, 1},
+		{"MTU", config.MTU, DefaultMTU},
+		{"ReadBatchSize", config.ReadBatchSize, DefaultBatchSize},
+		{"WriteBatchSize", config.WriteBatchSize, DefaultBatchSize},
+		{"ReadEventQueueSize", config.ReadEventQueueSize, DefaultReadEventQueueSize},
+		{"WriteQueueSize", config.WriteQueueSize, DefaultWriteQueueSize},
+		{"PeerTableSize", config.PeerTableSize, DefaultPeerTableSize},
+		{"Dispatch.Workers", config.Dispatch.Workers, runtime.NumCPU()},
+		{"Dispatch.QueueSize", config.Dispatch.QueueSize, DefaultDispatchQueueSize},
+	} {
+		if c.got != c.want {
+			t.Errorf("%v = %v, want %v", c.name, c.got, c.want)
+		}
+	}
+
+	if config.ShutdownTimeout != DefaultShutdownTimeout {
+		t.Errorf("ShutdownTimeout = %v, want %v", config.ShutdownTimeout, DefaultShutdownTimeout)
+	}
+
+	config = Config{Socket: netudp.SocketOptions{ReusePort: true}}
+	config.setDefaults()
+	if config.ListenerN != runtime.NumCPU() {
+		t.Errorf("ListenerN with ReusePort = %v, want %v", config.ListenerN, runtime.NumCPU())
+	}
+
+	config = Config{MTU: 9000, ListenerN: 3}
+	config.setDefaults()
+	if config.MTU != 9000 || config.ListenerN != 3 {
+		t.Errorf("setDefaults replaced set fields: MTU %v, ListenerN %v", config.MTU, config.ListenerN)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	reusePort := netudp.SocketOptions{ReusePort: true}
+	tests := []struct {
+		name   string
+		config Config
+		err    string // a substring of the error, "" when it's valid
+	}{
+		{"zero", Config{}, ""},
+		{"negative ListenerN", Config{ListenerN: -1}, "ListenerN must not be negative"},
+		{"ListenerN without ReusePort", Config{ListenerN: 2}, "requires Socket.ReusePort"},
+		{"ListenerN with ReusePort", Config{ListenerN: 2, Socket: reusePort}, ""},
+		{"negative MTU", Config{MTU: -1}, "MTU must be in"},
+		{"MaxMTU", Config{MTU: MaxMTU}, ""},
+		{"MTU too large", Config{MTU: MaxMTU + 1}, "MTU must be in"},
+		{"MaxBatchSize", Config{ReadBatchSize: MaxBatchSize, WriteBatchSize: MaxBatchSize}, ""},
+		{"ReadBatchSize too large", Config{ReadBatchSize: MaxBatchSize + 1}, "ReadBatchSize must be in"},
+		{"WriteBatchSize too large", Config{WriteBatchSize: MaxBatchSize + 1}, "WriteBatchSize must be in"},
+		{"negative ReadEventQueueSize", Config{ReadEventQueueSize: -1}, "ReadEventQueueSize"},
+		{"negative WriteQueueSize", Config{WriteQueueSize: -1}, "WriteQueueSize"},
+		{"unknown LoadBalancing", Config{LoadBalancing: PeerHash + 1}, "unknown LoadBalancing"},
+		{"negative PeerTableSize", Config{PeerTableSize: -1}, "PeerTableSize"},
+		{"unknown Dispatch.Mode", Config{Dispatch: DispatchConfig{Mode: DispatchPerPeer + 1}}, "unknown Dispatch.Mode"},
+		{"unknown QueueFullPolicy", Config{Dispatch: DispatchConfig{QueueFullPolicy: QueueFullDropOldest + 1}}, "unknown Dispatch.QueueFullPolicy"},
+		{"negative Dispatch.Workers", Config{Dispatch: DispatchConfig{Workers: -1}}, "Dispatch.Workers"},
+		{"negative Dispatch.QueueSize", Config{Dispatch: DispatchConfig{QueueSize: -1}}, "Dispatch.QueueSize"},
+		{"SteerByCPU without ReusePort", Config{Steering: SteeringConfig{Policy: SteerByCPU}}, "requires Socket.ReusePort"},
+		{"SteerByCPU", Config{Steering: SteeringConfig{Policy: SteerByCPU}, Socket: reusePort}, ""},
+		{"SteerByProgram without Program", Config{Steering: SteeringConfig{Policy: SteerByProgram}, Socket: reusePort}, "requires Steering.Program"},
+		{"SteerByPayload bad size", Config{Steering: SteeringConfig{Policy: SteerByPayload, PayloadSize: 3}, Socket: reusePort}, "config:"},
+		{"unknown Steering.Policy", Config{Steering: SteeringConfig{Policy: SteerByProgram + 1}}, "unknown Steering.Policy"},
+		{"negative CPU", Config{CPUs: []int{0, -1}}, "CPUs must not be negative"},
+		{"negative ShutdownTimeout", Config{ShutdownTimeout: -1}, "ShutdownTimeout"},
+		{"negative ReadBuffer", Config{Socket: netudp.SocketOptions{ReadBuffer: -1}}, "Socket.ReadBuffer"},
+		{"negative WriteBuffer", Config{Socket: netudp.SocketOptions{WriteBuffer: -1}}, "Socket.WriteBuffer"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("validate() = %v, want nil", err)
+			case tt.err != "" && err == nil:
+				t.Fatalf("validate() = nil, want an error containing %q", tt.err)
+			case err != nil && !strings.Contains(err.Error(), tt.err):
+				t.Fatalf("validate() = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestConfigCPU(t *testing.T) {
+	config := Config{}
+	if cpu := config.cpu(3); cpu != -1 {
+		t.Errorf("cpu(3) without CPUs = %v, want -1", cpu)
+	}
+
+	config.CPUs = []int{4, 6}
+	for i, want := range []int{4, 6, 4, 6} {
+		if cpu := config.cpu(i); cpu != want {
+			t.Errorf("cpu(%v) = %v, want %v", i, cpu, want)
+		}
+	}
+}
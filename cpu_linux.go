@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+package fastudp
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// pinSocket sets SO_INCOMING_CPU of fd to cpu, it fails when the process isn't
+// allowed to run on cpu.
+func pinSocket(fd, cpu int) error {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return os.NewSyscallError("sched_getaffinity", err)
+	}
+
+	if !set.IsSet(cpu) {
+		return fmt.Errorf("cpu %v is not in the affinity of the process", cpu)
+	}
+
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_INCOMING_CPU, cpu))
+}
+
+// pinThread locks the calling goroutine to its OS thread and binds the thread to
+// cpu. The goroutine must exit without unlocking, the runtime then terminates the
+// thread instead of reusing it with the affinity.
+func pinThread(cpu int) error {
+	runtime.LockOSThread()
+
+	var set unix.CPUSet
+	set.Set(cpu)
+	return os.NewSyscallError("sched_setaffinity", unix.SchedSetaffinity(0, &set))
+}
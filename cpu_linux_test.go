@@ -0,0 +1,105 @@
+//go:build linux
+// +build linux
+
+package fastudp
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// affinityHandler reports the CPUs the thread running the handler may run on.
+type affinityHandler struct {
+	echoHandler
+	sets chan unix.CPUSet
+}
+
+func (h *affinityHandler) OnReadedAddrPort(data []byte, addr netip.AddrPort, w Writer) {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		h.OnError(err)
+	}
+
+	h.sets <- set
+	h.echoHandler.OnReadedAddrPort(data, addr, w)
+}
+
+// allowedCPU returns a CPU the process may run on.
+func allowedCPU(t *testing.T) int {
+	t.Helper()
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		t.Fatalf("SchedGetaffinity: %v", err)
+	}
+
+	for cpu := 0; cpu < len(set)*64; cpu++ {
+		if set.IsSet(cpu) {
+			return cpu
+		}
+	}
+
+	t.Skip("no CPU in the affinity of the process")
+	return -1
+}
+
+func TestServerCPUs(t *testing.T) {
+	cpu := allowedCPU(t)
+	config := DefaultConfig()
+	config.ListenerN = 1
+	config.CPUs = []int{cpu}
+	h := &affinityHandler{echoHandler: *newEchoHandler(), sets: make(chan unix.CPUSet, 1)}
+	svr := startServer(t, h, config)
+
+	loop := testLoops(svr)[0]
+	if loop.cpu != cpu {
+		t.Fatalf("event-loop cpu %v, want %v", loop.cpu, cpu)
+	}
+
+	got, err := unix.GetsockoptInt(loop.sock.fd, unix.SOL_SOCKET, unix.SO_INCOMING_CPU)
+	if err != nil {
+		t.Fatalf("getsockopt SO_INCOMING_CPU: %v", err)
+	}
+
+	if got != cpu {
+		t.Fatalf("SO_INCOMING_CPU %v, want %v", got, cpu)
+	}
+
+	// the inline handler runs on the pinned reader thread
+	conn := dialServer(t, svr)
+	if got := roundTrip(t, conn, []byte("ping")); string(got) != "ping" {
+		t.Fatalf("reply %q, want %q", got, "ping")
+	}
+
+	select {
+	case set := <-h.sets:
+		if set.Count() != 1 || !set.IsSet(cpu) {
+			t.Fatalf("handler thread may run on %d CPUs, want only cpu %v", set.Count(), cpu)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the handler wasn't called")
+	}
+}
+
+func TestServerCPUNotAllowed(t *testing.T) {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		t.Fatalf("SchedGetaffinity: %v", err)
+	}
+
+	cpu := len(set)*64 - 1
+	if set.IsSet(cpu) {
+		t.Skipf("cpu %v is in the affinity of the process", cpu)
+	}
+
+	config := DefaultConfig()
+	config.CPUs = []int{cpu}
+	svr, err := NewUDPServer("udp4", "127.0.0.1:0", newEchoHandler(), config)
+	if err == nil {
+		svr.Shutdown(context.Background())
+		t.Fatalf("NewUDPServer pinned to cpu %v succeeded", cpu)
+	}
+}
@@ -0,0 +1,139 @@
+package fastudp
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// DispatchStats are the counters of the worker queues, they are all zero for DispatchInline.
+type DispatchStats struct {
+	// Dispatched is the number of datagrams put into a worker queue.
+	Dispatched uint64
+	// Dropped is the number of datagrams dropped because a worker queue was full.
+	Dropped uint64
+	// Handled is the number of datagrams whose handler call has returned.
+	Handled uint64
+	// Queued is the number of datagrams currently waiting for a worker.
+	Queued int
+}
+
+type dispatchItem struct {
+	p *Packet
+	w Writer
+}
+
+// dispatcher runs the handler on worker goroutines, it owns the retained
+// packets it's given and releases them once handled or dropped.
+type dispatcher struct {
+	h          *handlers
+	mode       DispatchMode
+	policy     QueueFullPolicy
+	queues     []chan dispatchItem
+	wg         sync.WaitGroup
+	once       sync.Once
+	dispatched uint64
+	dropped    uint64
+	handled    uint64
+}
+
+func newDispatcher(h *handlers, config *DispatchConfig) *dispatcher {
+	d := &dispatcher{
+		h:      h,
+		mode:   config.Mode,
+		policy: config.QueueFullPolicy,
+	}
+
+	queueN := 1
+	if config.Mode == DispatchPerPeer {
+		queueN = config.Workers
+	}
+
+	d.queues = make([]chan dispatchItem, queueN)
+	for i := range d.queues {
+		d.queues[i] = make(chan dispatchItem, config.QueueSize)
+	}
+
+	for i := 0; i < config.Workers; i++ {
+		d.wg.Add(1)
+		go d.work(d.queues[i%queueN])
+	}
+
+	return d
+}
+
+func (d *dispatcher) work(queue chan dispatchItem) {
+	defer d.wg.Done()
+
+	for item := range queue {
+		d.h.handlePacket(item.p, item.w)
+		item.p.Release()
+		atomic.AddUint64(&d.handled, 1)
+	}
+}
+
+// dispatch queues p for a worker, p must be retained by the caller which hands
+// its reference over.
+func (d *dispatcher) dispatch(p *Packet, w Writer) {
+	queue := d.queues[0]
+	if len(d.queues) > 1 {
+		queue = d.queues[peerHash(p.addr)%uint32(len(d.queues))]
+	}
+
+	item := dispatchItem{p: p, w: w}
+	switch d.policy {
+	case QueueFullBlock:
+		queue <- item
+	case QueueFullDropNewest:
+		select {
+		case queue <- item:
+		default:
+			d.drop(p)
+			return
+		}
+	case QueueFullDropOldest:
+		for sent := false; !sent; {
+			select {
+			case queue <- item:
+				sent = true
+			default:
+				select {
+				case oldest := <-queue:
+					d.drop(oldest.p)
+				default:
+				}
+			}
+		}
+	}
+
+	atomic.AddUint64(&d.dispatched, 1)
+}
+
+func (d *dispatcher) drop(p *Packet) {
+	p.Release()
+	atomic.AddUint64(&d.dropped, 1)
+}
+
+// close waits for the workers to handle what is queued, dispatch must not be
+// called anymore.
+func (d *dispatcher) close() {
+	d.once.Do(func() {
+		for _, queue := range d.queues {
+			close(queue)
+		}
+		d.wg.Wait()
+	})
+}
+
+func (d *dispatcher) stats() DispatchStats {
+	stats := DispatchStats{
+		Dispatched: atomic.LoadUint64(&d.dispatched),
+		Dropped:    atomic.LoadUint64(&d.dropped),
+		Handled:    atomic.LoadUint64(&d.handled),
+	}
+
+	for _, queue := range d.queues {
+		stats.Queued += len(queue)
+	}
+
+	return stats
+}
@@ -0,0 +1,236 @@
+package fastudp
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingOwner counts the packets recycled by any goroutine.
+type countingOwner struct {
+	sync.Mutex
+	recycled int
+}
+
+func (o *countingOwner) detach(p *Packet) []byte {
+	return append([]byte(nil), p.data...)
+}
+
+func (o *countingOwner) recycle(p *Packet) {
+	o.Lock()
+	o.recycled++
+	o.Unlock()
+}
+
+// gateHandler records the first byte of every packet, the workers wait in
+// OnPacket until gate is closed.
+type gateHandler struct {
+	started chan struct{}
+	gate    chan struct{}
+	sync.Mutex
+	handled map[netip.AddrPort][]byte
+}
+
+func newGateHandler() *gateHandler {
+	return &gateHandler{
+		started: make(chan struct{}, 64),
+		gate:    make(chan struct{}),
+		handled: make(map[netip.AddrPort][]byte),
+	}
+}
+
+func (h *gateHandler) OnReaded([]byte, *net.UDPAddr) {}
+func (h *gateHandler) OnError(err error)             {}
+
+func (h *gateHandler) OnPacket(p *Packet, w Writer) {
+	h.started <- struct{}{}
+	<-h.gate
+
+	h.Lock()
+	h.handled[p.Addr()] = append(h.handled[p.Addr()], p.Data()[0])
+	h.Unlock()
+}
+
+func TestDispatcherQueueFullPolicy(t *testing.T) {
+	peer := netip.MustParseAddrPort("10.0.0.1:53")
+	tests := []struct {
+		policy     QueueFullPolicy
+		dispatched uint64 // the oldest packets were queued before being dropped
+		dropped    uint64
+		handled    []byte
+	}{
+		// the worker holds 0 while 1 and 2 fill the queue
+		{QueueFullBlock, 5, 0, []byte{0, 1, 2, 3, 4}},
+		{QueueFullDropNewest, 3, 2, []byte{0, 1, 2}},
+		{QueueFullDropOldest, 5, 2, []byte{0, 3, 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			h := newGateHandler()
+			o := &countingOwner{}
+			d := newDispatcher(newHandlers(h), &DispatchConfig{
+				Mode:            DispatchWorkerPool,
+				Workers:         1,
+				QueueSize:       2,
+				QueueFullPolicy: tt.policy,
+			})
+
+			dispatch := func(i byte) {
+				d.dispatch(&Packet{data: []byte{i}, addr: peer, refs: 1, owner: o}, nil)
+			}
+
+			dispatch(0)
+			<-h.started
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := byte(1); i < 5; i++ {
+					dispatch(i)
+				}
+			}()
+
+			if tt.policy != QueueFullBlock {
+				<-done
+				if stats := d.stats(); stats.Dropped != tt.dropped || stats.Queued != 2 {
+					t.Fatalf("stats with a full queue = %+v, want %d dropped and 2 queued", stats, tt.dropped)
+				}
+			} else {
+				select {
+				case <-done:
+					t.Fatal("dispatch didn't block on a full queue")
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+
+			close(h.gate)
+			<-done
+			d.close()
+
+			stats := d.stats()
+			want := DispatchStats{
+				Dispatched: tt.dispatched,
+				Dropped:    tt.dropped,
+				Handled:    uint64(len(tt.handled)),
+			}
+			if stats != want {
+				t.Fatalf("stats = %+v, want %+v", stats, want)
+			}
+
+			if got := h.handled[peer]; string(got) != string(tt.handled) {
+				t.Fatalf("handled %v, want %v", got, tt.handled)
+			}
+
+			// every packet is released once, handled or dropped
+			if o.recycled != 5 {
+				t.Fatalf("recycled %d packets, want 5", o.recycled)
+			}
+		})
+	}
+}
+
+func TestDispatcherPerPeerOrder(t *testing.T) {
+	h := newGateHandler()
+	close(h.gate)
+	h.started = make(chan struct{}, 1024)
+	d := newDispatcher(newHandlers(h), &DispatchConfig{
+		Mode:      DispatchPerPeer,
+		Workers:   4,
+		QueueSize: 16,
+	})
+
+	peers := []netip.AddrPort{
+		netip.MustParseAddrPort("10.0.0.1:53"),
+		netip.MustParseAddrPort("10.0.0.2:53"),
+		netip.MustParseAddrPort("[2001:db8::1]:443"),
+	}
+
+	o := &countingOwner{}
+	for i := 0; i < 100; i++ {
+		for _, peer := range peers {
+			d.dispatch(&Packet{data: []byte{byte(i)}, addr: peer, refs: 1, owner: o}, nil)
+		}
+	}
+	d.close()
+
+	for _, peer := range peers {
+		got := h.handled[peer]
+		if len(got) != 100 {
+			t.Fatalf("%v: handled %d packets, want 100", peer, len(got))
+		}
+
+		for i, b := range got {
+			if int(b) != i {
+				t.Fatalf("%v: packet %d handled at %d, a peer must keep its order", peer, b, i)
+			}
+		}
+	}
+}
+
+func TestServerDispatchModes(t *testing.T) {
+	for _, mode := range []DispatchMode{DispatchInline, DispatchWorkerPool, DispatchPerPeer} {
+		t.Run(mode.String(), func(t *testing.T) {
+			config := DefaultConfig()
+			config.Dispatch = DispatchConfig{Mode: mode, Workers: 2}
+			svr := startServer(t, newEchoHandler(), config)
+			conn := dialServer(t, svr)
+
+			for _, msg := range []string{"a", "bc", "def"} {
+				if got := roundTrip(t, conn, []byte(msg)); string(got) != msg {
+					t.Fatalf("echo of %q = %q", msg, got)
+				}
+			}
+		})
+	}
+}
+
+func TestServerPerPeerReplyOrder(t *testing.T) {
+	config := DefaultConfig()
+	config.Dispatch = DispatchConfig{Mode: DispatchPerPeer, Workers: 4}
+	svr := startServer(t, newEchoHandler(), config)
+
+	// the workers write concurrently to one event-loop, the replies of a peer
+	// leave in the order its worker wrote them, whether sent or queued
+	const peers, n = 4, 50
+	errC := make(chan error, peers)
+	var wg sync.WaitGroup
+	for i := 0; i < peers; i++ {
+		conn := dialServer(t, svr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				if _, err := conn.Write([]byte(strconv.Itoa(j))); err != nil {
+					errC <- err
+					return
+				}
+			}
+
+			buf := make([]byte, MaxMTU)
+			for j := 0; j < n; j++ {
+				conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				m, err := conn.Read(buf)
+				if err != nil {
+					errC <- fmt.Errorf("reply %d: %v", j, err)
+					return
+				}
+
+				if got := string(buf[:m]); got != strconv.Itoa(j) {
+					errC <- fmt.Errorf("reply %q at %d, a peer must keep its order", got, j)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errC)
+	for err := range errC {
+		t.Fatal(err)
+	}
+}
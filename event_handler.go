@@ -1,8 +1,181 @@
 package fastudp
 
-import "net"
+import (
+	"net"
+	"net/netip"
 
+	"github.com/shaoyuan1943/fastudp/netudp"
+)
+
+// EventHandler gets the datagrams of every listener of a server through OnReaded,
+// a handler which needs to tell them apart implements one of the richer read
+// callbacks below, whose Writer reports the Listener.
 type EventHandler interface {
 	OnReaded([]byte, *net.UDPAddr)
 	OnError(err error)
 }
+
+// Writer sends datagrams through one socket.
+type Writer interface {
+	WriteTo(data []byte, addr *net.UDPAddr) (int, error)
+	WriteToAddrPort(data []byte, addr netip.AddrPort) (int, error)
+	// WriteMsgTo sends data to addr from the local address src through the interface
+	// ifIndex, a zero src or ifIndex lets the kernel pick it. Replying with the
+	// Packet.LocalAddr and Packet.IfIndex of a request makes the reply leave from the
+	// address the peer targeted. src and ifIndex are ignored on windows.
+	WriteMsgTo(data []byte, addr netip.AddrPort, src netip.Addr, ifIndex int) (int, error)
+	// WriteMsg sends one message with all its options, its Status and Err are left
+	// untouched. Only the address of msg is used on windows.
+	WriteMsg(msg *Message) (int, error)
+	// WriteBatch sends msgs with as few syscalls as possible and reports the result of
+	// every message in its Status and Err. It returns the number of messages sent or
+	// queued and the first error.
+	WriteBatch(msgs []Message) (int, error)
+	// Listener returns the listener datagrams are sent from, for the Writer of a
+	// read callback the one which read the datagram.
+	Listener() *Listener
+}
+
+// WriterEventHandler is an EventHandler which also gets the Writer of the event-loop
+// that read the datagram, a reply written to it leaves through the receiving socket
+// without server lock or event-loop lookup, w.Listener() is the listener which read
+// it. OnReadedWith is called instead of OnReaded.
+type WriterEventHandler interface {
+	EventHandler
+	OnReadedWith(data []byte, addr *net.UDPAddr, w Writer)
+}
+
+// AddrPortEventHandler is WriterEventHandler with the peer as a netip.AddrPort,
+// which is safe to retain and comparable. OnReadedAddrPort is called instead of
+// OnReadedWith and OnReaded.
+type AddrPortEventHandler interface {
+	EventHandler
+	OnReadedAddrPort(data []byte, addr netip.AddrPort, w Writer)
+}
+
+// PacketEventHandler receives every datagram as a Packet, which can be retained
+// beyond the call. OnPacket is called instead of all other read callbacks.
+type PacketEventHandler interface {
+	EventHandler
+	OnPacket(p *Packet, w Writer)
+}
+
+// DropEventHandler is told when the kernel dropped datagrams of ln because the
+// receive queue of one of its sockets was full, n is the number of new drops.
+// It needs Config.Socket.RecvDrops and is called from the event-loop.
+type DropEventHandler interface {
+	EventHandler
+	OnDropped(ln *Listener, n uint64)
+}
+
+// PeerErrorEventHandler is told about the errors reported for the datagrams ln
+// sent to a peer, such as ICMP port unreachable, the event-loop keeps running.
+// It needs Config.Socket.RecvErr, a handler which doesn't implement it gets the
+// *netudp.PeerError in OnError.
+type PeerErrorEventHandler interface {
+	EventHandler
+	OnPeerError(ln *Listener, err *netudp.PeerError)
+}
+
+// WriteStatus is the result of one message of a batch write.
+type WriteStatus int
+
+const (
+	// WritePending means the message has not been handled.
+	WritePending WriteStatus = iota
+	// WriteSent means the message was handed to the kernel.
+	WriteSent
+	// WriteQueued means the socket was busy, the message was copied into the write queue.
+	WriteQueued
+	// WriteFailed means the message was dropped, Message.Err holds the reason.
+	WriteFailed
+)
+
+func (status WriteStatus) String() string {
+	switch status {
+	case WritePending:
+		return "pending"
+	case WriteSent:
+		return "sent"
+	case WriteQueued:
+		return "queued"
+	case WriteFailed:
+		return "failed"
+	}
+
+	return "unknown"
+}
+
+// Message is one datagram of Writer.WriteBatch, it's sent to Addr or,
+// when Addr is nil, to AddrPort. Src and IfIndex work like in Writer.WriteMsgTo,
+// TOS and TTL override Config.Socket.TOS and Config.Socket.TTL when they aren't 0.
+// Done is called once Data can be reused: after the message was sent or copied
+// into the write queue or, with Config.ZeroCopy, from the event-loop when the
+// kernel completed the zero-copy send. It isn't called for a failed message.
+type Message struct {
+	Addr     *net.UDPAddr
+	AddrPort netip.AddrPort
+	Src      netip.Addr
+	IfIndex  int
+	TOS      int
+	TTL      int
+	Data     []byte
+	Done     func()
+	Status   WriteStatus
+	Err      error
+}
+
+func (msg *Message) addrPort() netip.AddrPort {
+	if msg.Addr != nil {
+		return netudp.AddrPortOf(msg.Addr)
+	}
+
+	return msg.AddrPort
+}
+
+// sent calls Done of a message whose data can be reused.
+func (msg *Message) sent() {
+	if msg.Done != nil {
+		msg.Done()
+	}
+}
+
+func (msg *Message) fail(err error) {
+	msg.Status = WriteFailed
+	msg.Err = err
+}
+
+// handlers caches the extended interfaces implemented by an EventHandler.
+type handlers struct {
+	EventHandler
+	wh WriterEventHandler
+	ah AddrPortEventHandler
+	ph PacketEventHandler
+	dh DropEventHandler
+	eh PeerErrorEventHandler
+}
+
+func newHandlers(handler EventHandler) *handlers {
+	h := &handlers{EventHandler: handler}
+	h.wh, _ = handler.(WriterEventHandler)
+	h.ah, _ = handler.(AddrPortEventHandler)
+	h.ph, _ = handler.(PacketEventHandler)
+	h.dh, _ = handler.(DropEventHandler)
+	h.eh, _ = handler.(PeerErrorEventHandler)
+	return h
+}
+
+// handlePacket calls the richest read callback with the data of p, the
+// caller keeps its reference of p.
+func (h *handlers) handlePacket(p *Packet, w Writer) {
+	switch {
+	case h.ph != nil:
+		h.ph.OnPacket(p, w)
+	case h.ah != nil:
+		h.ah.OnReadedAddrPort(p.data, p.addr, w)
+	case h.wh != nil:
+		h.wh.OnReadedWith(p.data, net.UDPAddrFromAddrPort(p.addr), w)
+	default:
+		h.OnReaded(p.data, net.UDPAddrFromAddrPort(p.addr))
+	}
+}
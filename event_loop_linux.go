@@ -4,11 +4,16 @@
 package fastudp
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -17,11 +22,8 @@ import (
 	"github.com/shaoyuan1943/fastudp/netudp"
 )
 
-var (
-	MsgHdrSize     = 128
-	ReadEventSize  = 128
-	WriteEventSize = 128
-)
+// drainPollInterval bounds how long drain waits for the socket to become writable.
+const drainPollInterval = 10 * time.Millisecond
 
 type eventLoop struct {
 	internalLoop
@@ -29,66 +31,195 @@ type eventLoop struct {
 }
 
 type internalLoop struct {
-	l           *listener
+	drops       uint64 // atomic, first for its alignment
+	lastDrops   uint32 // latest drop count of the socket
+	errPending  int32  // atomic, 1 when EPOLLERR was reported
+	cpu         int    // CPU the goroutines are pinned to, -1 when not pinned
+	sock        *socket
+	ln          *Listener
 	poller      *netpoll.Poller
 	rw          *netudp.ReaderWriter
 	svr         *Server
+	bufPool     *bufferPool
+	packetPool  sync.Pool
+	readFunc    func([]byte, netip.AddrPort, error)
+	readAgain   bool
+	remoteAddr  net.UDPAddr
+	remoteIP    [16]byte
 	once        sync.Once
 	readNotifyC chan struct{}
+	readDone    chan struct{}
 	writePool   sync.Pool
 	closed      atomic.Value
+	reading     atomic.Value
+	err         error
 	writeQueue  []*netudp.Mmsg
-	sync.Locker
+	config      *Config
+	sync.Mutex
 }
 
-func newEventLoop(s *Server, l *listener, poller *netpoll.Poller, mtu int) *eventLoop {
+func newEventLoop(s *Server, ln *Listener, sock *socket, poller *netpoll.Poller) *eventLoop {
 	loop := &eventLoop{}
-	loop.l = l
+	loop.sock = sock
+	loop.ln = ln
+	loop.cpu = -1
 	loop.poller = poller
-	loop.rw = netudp.NewRW(l.fd, MsgHdrSize, mtu)
+	loop.config = &s.config
+	loop.rw = netudp.NewRW(sock.fd, loop.config.ReadBatchSize, loop.config.MTU)
+	if loop.config.GSO {
+		loop.rw.EnableGSO()
+	}
+	if loop.config.GRO {
+		loop.rw.EnableGRO()
+	}
+	if loop.config.PacketInfo {
+		loop.rw.EnablePktInfo()
+	}
+	if loop.config.ZeroCopy {
+		loop.rw.EnableZeroCopy()
+	}
+	if loop.config.IOURing {
+		loop.rw.EnableURing()
+	}
 	loop.svr = s
-	loop.readNotifyC = make(chan struct{}, ReadEventSize)
+	loop.readFunc = loop.onRead
+	loop.bufPool = newBufferPool(loop.config.MTU, loop.config.ReadBatchSize*4)
+	loop.packetPool.New = func() interface{} {
+		return &Packet{owner: loop}
+	}
+	loop.readNotifyC = make(chan struct{}, loop.config.ReadEventQueueSize)
+	loop.readDone = make(chan struct{})
 	loop.writePool.New = func() interface{} {
 		p := &netudp.Mmsg{
-			Data: make([]byte, mtu),
+			Data: make([]byte, loop.config.MTU),
 		}
 
 		return p
 	}
-	loop.writeQueue = make([]*netudp.Mmsg, WriteEventSize)
-	loop.writeQueue = loop.writeQueue[:0]
+	loop.writeQueue = make([]*netudp.Mmsg, 0, loop.config.WriteBatchSize)
 	loop.closed.Store(false)
+	loop.reading.Store(true)
 	return loop
 }
 
+// Close stops the event-loop, the first non-nil err is reported to the server
+// once the poller and reader goroutines have exited.
 func (loop *eventLoop) Close(err error) {
 	loop.once.Do(func() {
-		loop.poller.Del(loop.l.fd)
-		loop.poller.Close()
-		close(loop.readNotifyC)
+		loop.err = err
+		loop.reading.Store(false)
 		loop.closed.Store(true)
-		loop.svr.eventLoopClosed(loop, err)
+		loop.poller.Shutdown()
 	})
 }
 
-func (loop *eventLoop) run(lockThread bool) {
-	if lockThread {
+func (loop *eventLoop) run() {
+	switch {
+	case loop.cpu >= 0:
+		loop.pin()
+	case loop.config.LockOSThread:
 		runtime.LockOSThread()
 		defer runtime.UnlockOSThread()
 	}
 
 	err := loop.poller.Polling(loop.pollEvent)
 	loop.Close(err)
+
+	// pollEvent is the only sender of readNotifyC, it can be closed safely now.
+	close(loop.readNotifyC)
+	if loop.rw.URing() {
+		loop.rw.WakeURing()
+	}
+	<-loop.readDone
+
+	// the writers check closed with loop locked, the fds can't be reused under
+	// a write once the lock is taken
+	loop.Lock()
+	loop.rw.CloseURing()
+	loop.poller.Close()
+	unix.Close(loop.sock.fd)
+	for _, p := range loop.writeQueue {
+		loop.writePool.Put(p)
+	}
+	loop.writeQueue = loop.writeQueue[:0]
+	loop.Unlock()
+
+	loop.svr.eventLoopClosed(loop, loop.err)
+}
+
+// stopRead makes the event-loop ignore readable events, pending writes are still flushed.
+func (loop *eventLoop) stopRead() {
+	loop.reading.Store(false)
+	if loop.rw.URing() {
+		loop.rw.StopURing()
+	}
+}
+
+// pathMTU returns the path MTU of a connected socket, see netudp.ReaderWriter.PathMTU.
+func (loop *eventLoop) pathMTU() (int, error) {
+	loop.Lock()
+	defer loop.Unlock()
+
+	if loop.closed.Load().(bool) {
+		return 0, fmt.Errorf("event-loop closed")
+	}
+
+	return loop.rw.PathMTU()
+}
+
+// drain flushes the write queue until it's empty or ctx is done.
+func (loop *eventLoop) drain(ctx context.Context) error {
+	for {
+		loop.Lock()
+		if loop.closed.Load().(bool) {
+			loop.Unlock()
+			return nil
+		}
+
+		loop.flush()
+		n := len(loop.writeQueue)
+		loop.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		timeout := drainPollInterval
+		if deadline, ok := ctx.Deadline(); ok {
+			if d := time.Until(deadline); d < timeout {
+				timeout = d
+			}
+		}
+
+		// the fd may be closed and reused meanwhile, the poll only returns early then
+		if timeout > 0 {
+			fds := []unix.PollFd{{Fd: int32(loop.sock.fd), Events: unix.POLLOUT}}
+			unix.Poll(fds, int(timeout/time.Millisecond)+1)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+	}
 }
 
 // Epoll return current status of fd,
 // EPOLLOUT will only be returned when the fd's status changes from "cannnot ouput" to "can ouput",
 // More information: https://www.spinics.net/lists/linux-api/msg01872.html
 func (loop *eventLoop) pollEvent(fd int32, events uint32) {
-	if fd == int32(loop.l.fd) && netudp.IsUDP(loop.l.network) {
+	if fd == int32(loop.sock.fd) && netudp.IsUDP(loop.sock.network) {
 		if !loop.closed.Load().(bool) {
-			if events&unix.EPOLLIN != 0 {
-				loop.readNotifyC <- struct{}{}
+			if events&unix.EPOLLERR != 0 {
+				atomic.StoreInt32(&loop.errPending, 1)
+			}
+
+			if events&(unix.EPOLLIN|unix.EPOLLERR) != 0 && loop.reading.Load().(bool) {
+				if loop.rw.URing() {
+					loop.rw.WakeURing()
+				} else {
+					loop.readNotifyC <- struct{}{}
+				}
 			}
 
 			if events&unix.EPOLLOUT != 0 {
@@ -99,122 +230,561 @@ func (loop *eventLoop) pollEvent(fd int32, events uint32) {
 }
 
 func (loop *eventLoop) readLoop() {
-	for _ = range loop.readNotifyC {
-		loop.rw.ReadFrom(func(data []byte, addr *net.UDPAddr, err error) {
-			if err != nil {
-				loop.Close(err)
-				return
+	defer close(loop.readDone)
+
+	if loop.cpu >= 0 {
+		loop.pin()
+	}
+
+	for range loop.readNotifyC {
+		if atomic.CompareAndSwapInt32(&loop.errPending, 1, 0) {
+			loop.readErrQueue()
+		}
+
+		// the socket is edge triggered, read until it's drained
+		for loop.reading.Load().(bool) {
+			loop.readAgain = false
+			n := loop.rw.ReadFromAddrPort(loop.readFunc)
+			loop.checkDrops()
+			if n == 0 && !loop.readAgain {
+				break
 			}
+		}
+	}
+}
+
+// ringLoop is readLoop for a socket read through io_uring: the datagrams the
+// ring received are delivered, then it waits for more.
+func (loop *eventLoop) ringLoop() {
+	defer close(loop.readDone)
+
+	if loop.cpu >= 0 {
+		loop.pin()
+	}
 
-			loop.svr.handler.OnReaded(data, addr)
-		})
+	for !loop.closed.Load().(bool) {
+		if atomic.CompareAndSwapInt32(&loop.errPending, 1, 0) {
+			loop.readErrQueue()
+		}
+
+		// after stopRead the recvmsg is cancelled, what the ring received before
+		// is still delivered
+		loop.readAgain = false
+		n := loop.rw.ReadFromAddrPort(loop.readFunc)
+		loop.checkDrops()
+		if n > 0 || loop.readAgain {
+			continue
+		}
+
+		if err := loop.rw.WaitURing(); err != nil {
+			loop.Close(err)
+			return
+		}
+	}
+}
+
+// pollMode returns the events the poller watches the socket for, readable
+// events are useless when the socket is read through io_uring.
+func (loop *eventLoop) pollMode(write bool) string {
+	switch {
+	case loop.rw.URing() && write:
+		return "w"
+	case loop.rw.URing():
+		return "e"
+	case write:
+		return "rw"
+	}
+
+	return "r"
+}
+
+// pin binds the calling goroutine to the CPU of loop, the loop keeps running
+// unpinned when it fails.
+func (loop *eventLoop) pin() {
+	if err := pinThread(loop.cpu); err != nil {
+		loop.svr.handler.OnError(err)
+	}
+}
+
+// readErrQueue delivers the errors queued on the socket for the datagrams sent.
+func (loop *eventLoop) readErrQueue() {
+	if _, err := loop.rw.ReadErrQueue(loop.onPeerError); err != nil {
+		loop.svr.handler.OnError(err)
+	}
+}
+
+func (loop *eventLoop) onPeerError(e *netudp.PeerError) {
+	if eh := loop.svr.handlers.eh; eh != nil {
+		eh.OnPeerError(loop.ln, e)
+		return
+	}
+
+	loop.svr.handler.OnError(e)
+}
+
+// checkDrops accounts the datagrams the kernel dropped since the last check.
+func (loop *eventLoop) checkDrops() {
+	drops := loop.rw.Drops()
+	if drops == loop.lastDrops {
+		return
+	}
+
+	n := uint64(drops - loop.lastDrops)
+	loop.lastDrops = drops
+	atomic.AddUint64(&loop.drops, n)
+	atomic.AddUint64(&loop.svr.drops, n)
+	if dh := loop.svr.handlers.dh; dh != nil {
+		dh.OnDropped(loop.ln, n)
 	}
 }
 
-func (loop *eventLoop) writeTo(data []byte, addr *net.UDPAddr) (int, error) {
-	err := loop.rw.WriteTo(data, addr)
+func (loop *eventLoop) onRead(data []byte, addr netip.AddrPort, err error) {
 	if err != nil {
-		errno := err.(*os.SyscallError).Unwrap()
-		if errno.Error() == "EINTR" || errno.Error() == "EAGIN" {
-			loop.Lock()
-			defer loop.Unlock()
-
-			p := loop.writePool.Get().(*netudp.Mmsg)
-			p.Addr = addr
-			p.Data = p.Data[:len(data)]
-			copy(p.Data, data)
-
-			loop.writeQueue = append(loop.writeQueue, p)
-			loop.poller.Mod(loop.l.fd, "rw")
-			err = errno
-		} else {
-			loop.Close(err)
+		if isPeerError(err) {
+			// a pending ICMP error, datagrams may still be queued. The error queue
+			// reports it with the address of the peer when it's enabled.
+			loop.readAgain = true
+			if !loop.config.Socket.RecvErr {
+				loop.svr.handler.OnError(err)
+			}
+			return
 		}
+
+		loop.Close(err)
+		return
+	}
+
+	loop.ln.lb.observe(loop, addr)
+	h := loop.svr.handlers
+	switch {
+	case loop.svr.dispatcher != nil:
+		// the worker owns the packet, its buffer must leave the read batch
+		p := loop.newPacket(data, addr)
+		p.own()
+		loop.svr.dispatcher.dispatch(p, loop)
+	case h.ph != nil:
+		p := loop.newPacket(data, addr)
+		h.ph.OnPacket(p, loop)
+		p.Release()
+	case h.ah != nil:
+		h.ah.OnReadedAddrPort(data, addr, loop)
+	case h.wh != nil:
+		h.wh.OnReadedWith(data, loop.udpAddr(addr), loop)
+	default:
+		h.OnReaded(data, loop.udpAddr(addr))
 	}
+}
+
+func (loop *eventLoop) newPacket(data []byte, addr netip.AddrPort) *Packet {
+	p := loop.packetPool.Get().(*Packet)
+	p.data = data
+	p.addr = addr
+	p.ln = loop.ln
+	p.cm = *loop.rw.Control()
+	p.refs = 1
+	return p
+}
+
+func (loop *eventLoop) detach(p *Packet) []byte {
+	return loop.rw.Detach(loop.bufPool.get())
+}
+
+func (loop *eventLoop) recycle(p *Packet) {
+	if p.buf != nil {
+		loop.bufPool.put(p.buf)
+	}
+
+	p.reset()
+	loop.packetPool.Put(p)
+}
+
+// Listener implements Writer, it returns the listener loop serves.
+func (loop *eventLoop) Listener() *Listener {
+	return loop.ln
+}
+
+// udpAddr converts addr into a *net.UDPAddr which is reused by the next datagram.
+func (loop *eventLoop) udpAddr(addr netip.AddrPort) *net.UDPAddr {
+	ip := addr.Addr()
+	if ip.Is4() {
+		b := ip.As4()
+		copy(loop.remoteIP[:], b[:])
+		loop.remoteAddr.IP = loop.remoteIP[:4]
+	} else {
+		loop.remoteIP = ip.As16()
+		loop.remoteAddr.IP = loop.remoteIP[:]
+	}
+	loop.remoteAddr.Port = int(addr.Port())
+	loop.remoteAddr.Zone = ip.Zone()
+	return &loop.remoteAddr
+}
+
+// WriteTo implements Writer, data is sent through the socket of loop and
+// queued when the socket is busy.
+func (loop *eventLoop) WriteTo(data []byte, addr *net.UDPAddr) (int, error) {
+	if addr == nil {
+		return 0, fmt.Errorf("writeto: data or addr invalid")
+	}
+
+	return loop.WriteToAddrPort(data, netudp.AddrPortOf(addr))
+}
 
-	return len(data), err
+// WriteToAddrPort implements Writer.
+func (loop *eventLoop) WriteToAddrPort(data []byte, addr netip.AddrPort) (int, error) {
+	return loop.write(netudp.Mmsg{Addr: addr, Data: data}, writeTo)
 }
 
-// write return value
+// WriteMsgTo implements Writer.
+func (loop *eventLoop) WriteMsgTo(data []byte, addr netip.AddrPort, src netip.Addr, ifIndex int) (int, error) {
+	return loop.write(netudp.Mmsg{Addr: addr, Data: data, Src: src, IfIndex: ifIndex}, writeMsgTo)
+}
+
+// WriteMsg implements Writer.
+func (loop *eventLoop) WriteMsg(msg *Message) (int, error) {
+	if !msg.addrPort().IsValid() {
+		return 0, fmt.Errorf("writemsg: addr invalid")
+	}
+
+	return loop.write(msg.mmsg(), writeMsg)
+}
+
+// Write sends data to the peer of a connected socket.
+func (loop *eventLoop) Write(data []byte) (int, error) {
+	return loop.write(netudp.Mmsg{Data: data}, writeConnected)
+}
+
+// writeOp selects the send of a direct write.
+type writeOp int
+
 const (
-	retry   = 1 << iota
-	failed  = 1 << iota
-	succeed = 1 << iota
+	writeTo writeOp = iota
+	writeMsgTo
+	writeMsg
+	writeConnected
 )
 
-func (loop *eventLoop) onEpollout() {
-	n := len(loop.writeQueue)
-	if n <= 0 {
-		return
+// send sends msg with the syscall of op.
+func (loop *eventLoop) send(op writeOp, msg *netudp.Mmsg) error {
+	switch op {
+	case writeMsgTo:
+		return loop.rw.WriteMsgTo(msg.Data, msg.Addr, msg.Src, msg.IfIndex)
+	case writeMsg:
+		return loop.rw.WriteMsg(msg)
+	case writeConnected:
+		return loop.rw.Write(msg.Data)
 	}
 
-	writeFunc := func(mmsgs []*netudp.Mmsg) (writed int) {
-		if len(mmsgs) > 0 {
-			_, err := loop.rw.WriteToN(mmsgs...)
-			if err != nil {
-				errno := err.(*os.SyscallError).Unwrap()
-				if errno.Error() == "EINTR" || errno.Error() == "EAGIN" {
-					writed = retry
-					return
-				}
+	return loop.rw.WriteToAddrPort(msg.Data, msg.Addr)
+}
 
-				loop.Close(err)
-				writed = failed
-				return
+// write sends msg by op, or queues it when the socket is busy or datagrams
+// are queued already. The Done of msg is called once loop is unlocked, unless
+// the zero-copy send calls it on completion.
+func (loop *eventLoop) write(msg netudp.Mmsg, op writeOp) (int, error) {
+	done := msg.Done
+	if !loop.rw.ZeroCopy() {
+		msg.Done = nil
+	}
+
+	loop.Lock()
+	queued, err := loop.sendOrQueue(msg, op)
+	loop.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	if done != nil && (queued || msg.Done == nil) {
+		done()
+	}
+
+	return len(msg.Data), nil
+}
+
+// sendOrQueue sends msg directly only while the write queue is empty, the lock is
+// held across the check and the send so that msg can't overtake a datagram queued
+// by another goroutine. It reports whether msg was queued: the socket is busy.
+// A broken socket closes loop. It must be called with loop locked.
+func (loop *eventLoop) sendOrQueue(msg netudp.Mmsg, op writeOp) (bool, error) {
+	if loop.closed.Load().(bool) {
+		return false, fmt.Errorf("event-loop closed")
+	}
+
+	if len(loop.writeQueue) > 0 {
+		return true, loop.push(msg)
+	}
+
+	err := loop.send(op, &msg)
+	if loop.isPendingError(err) {
+		err = loop.send(op, &msg)
+	}
+
+	switch {
+	case err == nil:
+		return false, nil
+	case !isSyscallError(err):
+		return false, err
+	case isPeerError(err):
+		return false, loop.peerError(msg.Addr, err)
+	case !isTemporary(err):
+		loop.Close(err)
+		return false, err
+	}
+
+	return true, loop.push(msg)
+}
+
+func (msg *Message) mmsg() netudp.Mmsg {
+	return netudp.Mmsg{Addr: msg.addrPort(), Data: msg.Data, Src: msg.Src, IfIndex: msg.IfIndex, TOS: msg.TOS, TTL: msg.TTL, Done: msg.Done}
+}
+
+// WriteBatch implements Writer, msgs are sent in order by sendmmsg, at most
+// WriteBatchSize per call, the remainder is queued once the socket is busy or
+// when datagrams are queued already. A broken socket fails the remainder and
+// closes the event-loop like the other writes do.
+func (loop *eventLoop) WriteBatch(msgs []Message) (int, error) {
+	var firstErr error
+	fail := func(msg *Message, err error) {
+		msg.fail(err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	pending := make([]int, 0, len(msgs))
+	for i := range msgs {
+		msg := &msgs[i]
+		switch {
+		case !msg.addrPort().IsValid() || len(msg.Data) == 0:
+			fail(msg, fmt.Errorf("writebatch: data or addr invalid"))
+		case len(msg.Data) > loop.config.MTU:
+			fail(msg, &netudp.PeerError{Addr: msg.addrPort(), Err: unix.EMSGSIZE, Origin: unix.SO_EE_ORIGIN_LOCAL})
+		default:
+			msg.Status = WritePending
+			msg.Err = nil
+			pending = append(pending, i)
+		}
+	}
+
+	// Done is called once loop is unlocked, unless the zero-copy send calls it
+	zeroCopy := loop.rw.ZeroCopy()
+	mmsgs := make([]netudp.Mmsg, loop.config.WriteBatchSize)
+	batch := make([]*netudp.Mmsg, 0, loop.config.WriteBatchSize)
+
+	// the lock is held across the sends like in sendOrQueue
+	loop.Lock()
+	if loop.closed.Load().(bool) {
+		for _, i := range pending {
+			fail(&msgs[i], fmt.Errorf("event-loop closed"))
+		}
+		pending = pending[:0]
+	}
+
+	// with datagrams queued already the batch joins them
+	busy := len(loop.writeQueue) > 0
+	for len(pending) > 0 && !busy {
+		batch = batch[:0]
+		for i := 0; i < len(pending) && i < len(mmsgs); i++ {
+			mmsgs[i] = msgs[pending[i]].mmsg()
+			if !zeroCopy {
+				mmsgs[i].Done = nil
 			}
+			batch = append(batch, &mmsgs[i])
 		}
 
-		writed = succeed
-		return
+		n, err := loop.rw.WriteToN(batch...)
+		if loop.isPendingError(err) {
+			n, err = loop.rw.WriteToN(batch...)
+		}
+
+		for _, i := range pending[:n] {
+			msgs[i].Status = WriteSent
+		}
+		pending = pending[n:]
+
+		switch {
+		case err != nil && isTemporary(err):
+			busy = true
+		case err != nil && isSyscallError(err) && !isPeerError(err):
+			// the socket is broken, as in sendOrQueue
+			loop.Close(err)
+			for _, i := range pending {
+				fail(&msgs[i], err)
+			}
+			pending = pending[:0]
+		case err != nil:
+			// sendmmsg stopped at the first message it could not send, skip it
+			if isPeerError(err) {
+				err = loop.peerError(mmsgs[0].Addr, err)
+			}
+			fail(&msgs[pending[0]], err)
+			pending = pending[1:]
+		case n == 0:
+			busy = true
+		}
+		// after a partial send the next sendmmsg tells whether the socket is
+		// busy or the first message left can't be sent
 	}
 
-	returnBackFunc := func(mmsgs []*netudp.Mmsg) {
-		for i := 0; i < len(mmsgs); i++ {
-			loop.writePool.Put(mmsgs[i])
+	for _, i := range pending {
+		if err := loop.push(msgs[i].mmsg()); err != nil {
+			fail(&msgs[i], err)
+			continue
+		}
+
+		msgs[i].Status = WriteQueued
+	}
+	loop.Unlock()
+
+	accepted := 0
+	for i := range msgs {
+		switch msgs[i].Status {
+		case WriteSent:
+			if !zeroCopy {
+				msgs[i].sent()
+			}
+			accepted++
+		case WriteQueued:
+			msgs[i].sent()
+			accepted++
 		}
 	}
 
+	return accepted, firstErr
+}
+
+// push copies msg into the write queue, it's sent when the socket is writable.
+// It must be called with loop locked.
+func (loop *eventLoop) push(msg netudp.Mmsg) error {
+	if len(loop.writeQueue) >= loop.config.WriteQueueSize {
+		return fmt.Errorf("write queue full")
+	}
+
+	p := loop.writePool.Get().(*netudp.Mmsg)
+	p.Addr = msg.Addr
+	p.Src = msg.Src
+	p.IfIndex = msg.IfIndex
+	p.TOS = msg.TOS
+	p.TTL = msg.TTL
+	p.Data = p.Data[:len(msg.Data)]
+	copy(p.Data, msg.Data)
+
+	loop.writeQueue = append(loop.writeQueue, p)
+	loop.poller.Mod(loop.sock.fd, loop.pollMode(true))
+	return nil
+}
+
+func (loop *eventLoop) queueLen() int {
 	loop.Lock()
 	defer loop.Unlock()
 
-	if n <= WriteEventSize {
-		switch writeFunc(loop.writeQueue) {
-		case retry:
-		case failed:
-			return
-		case succeed:
-			returnBackFunc(loop.writeQueue)
-			loop.writeQueue = loop.writeQueue[:0]
+	return len(loop.writeQueue)
+}
+
+func (loop *eventLoop) onEpollout() {
+	loop.Lock()
+	defer loop.Unlock()
+
+	if len(loop.writeQueue) == 0 {
+		return
+	}
+
+	loop.flush()
+	if len(loop.writeQueue) == 0 {
+		loop.poller.Mod(loop.sock.fd, loop.pollMode(false))
+	}
+}
+
+// flush writes the queued datagrams in order, at most WriteBatchSize per sendmmsg,
+// it stops at the first temporary error and must be called with loop locked.
+func (loop *eventLoop) flush() {
+	sent := 0
+	for sent < len(loop.writeQueue) {
+		end := sent + loop.config.WriteBatchSize
+		if end > len(loop.writeQueue) {
+			end = len(loop.writeQueue)
 		}
-	} else {
-		step := n / WriteEventSize
-		surplus := n % WriteEventSize
-		if surplus > 0 {
-			switch writeFunc(loop.writeQueue[(n - surplus):n]) {
-			case retry:
-			case failed:
-				return
-			case succeed:
-				returnBackFunc(loop.writeQueue[(n - surplus):n])
-				loop.writeQueue = loop.writeQueue[:(n - surplus)]
-			}
+
+		batch := loop.writeQueue[sent:end]
+		n, err := loop.rw.WriteToN(batch...)
+		if loop.isPendingError(err) {
+			n, err = loop.rw.WriteToN(batch...)
 		}
 
-		n := len(loop.writeQueue)
-		step--
-		for step >= 0 {
-			switch writeFunc(loop.writeQueue[step*WriteEventSize : n]) {
-			case retry:
-			case failed:
-				return
-			case succeed:
-				returnBackFunc(loop.writeQueue[step*WriteEventSize : n])
-				loop.writeQueue = loop.writeQueue[:step*WriteEventSize]
-				n = len(loop.writeQueue)
-				step--
+		if err != nil {
+			if isPeerError(err) {
+				// the first datagram can't reach its peer, drop it. With RecvErr the
+				// kernel also queued the error, EMSGSIZE with the path MTU.
+				sent++
+				continue
+			}
+
+			if !isTemporary(err) {
+				loop.Close(err)
 			}
+
+			break
+		}
+
+		sent += n
+		if n < len(batch) {
+			// partial send, the socket buffer is full
+			break
 		}
 	}
 
-	loop.poller.Mod(loop.l.fd, "rw")
+	for i := 0; i < sent; i++ {
+		loop.writePool.Put(loop.writeQueue[i])
+		loop.writeQueue[i] = nil
+	}
+
+	n := copy(loop.writeQueue, loop.writeQueue[sent:])
+	loop.writeQueue = loop.writeQueue[:n]
+}
+
+// isTemporary reports whether a write failed only because the socket is busy.
+func isTemporary(err error) bool {
+	return errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) || errors.Is(err, unix.ENOBUFS)
+}
+
+// peerError returns the error of a datagram to addr which failed with the peer
+// error err. EMSGSIZE becomes a *netudp.PeerError so that the caller can
+// re-segment, its Info is the path MTU on a connected socket. It's 0 otherwise:
+// with Config.Socket.RecvErr the kernel reports the MTU through OnPeerError,
+// Server.PathMTU queries it.
+func (loop *eventLoop) peerError(addr netip.AddrPort, err error) error {
+	if !errors.Is(err, unix.EMSGSIZE) {
+		return err
+	}
+
+	var mtu int
+	if !addr.IsValid() {
+		addr = loop.sock.remote
+		mtu, _ = loop.rw.PathMTU()
+	}
+
+	return &netudp.PeerError{Addr: addr, Err: unix.EMSGSIZE, Origin: unix.SO_EE_ORIGIN_LOCAL, Info: uint32(mtu)}
+}
+
+// isPeerError reports whether err was caused by a single peer, such as an ICMP
+// error reported on a connected socket or a datagram too large for its path,
+// the socket itself is fine.
+func isPeerError(err error) bool {
+	return errors.Is(err, unix.ECONNREFUSED) || errors.Is(err, unix.EHOSTUNREACH) ||
+		errors.Is(err, unix.ENETUNREACH) || errors.Is(err, unix.EHOSTDOWN) ||
+		errors.Is(err, unix.EMSGSIZE)
+}
+
+// isPendingError reports whether a send on loop failed with the ICMP error of
+// an earlier datagram: with IP_RECVERR an unconnected socket reports it on the
+// next send, whatever its peer, and doesn't send the datagram. The failure
+// consumes the error, the same send is retried once. Only EMSGSIZE is about
+// the datagram sent, the error queue reports the others with their peer.
+func (loop *eventLoop) isPendingError(err error) bool {
+	return err != nil && !loop.sock.remote.IsValid() && isPeerError(err) && !errors.Is(err, unix.EMSGSIZE)
+}
+
+// isSyscallError reports whether err comes from the kernel rather than from argument checks.
+func isSyscallError(err error) bool {
+	var sysErr *os.SyscallError
+	return errors.As(err, &sysErr)
 }
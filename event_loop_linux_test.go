@@ -0,0 +1,118 @@
+//go:build linux
+// +build linux
+
+package fastudp
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/shaoyuan1943/fastudp/netudp"
+)
+
+// closedAddr returns a loopback address nobody listens on.
+func closedAddr(t *testing.T) netip.AddrPort {
+	t.Helper()
+	conn := listenPeer(t)
+	addr := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	conn.Close()
+	return addr
+}
+
+func TestPendingPeerError(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(loop *eventLoop, data []byte, addr netip.AddrPort) error
+	}{
+		{"WriteToAddrPort", func(loop *eventLoop, data []byte, addr netip.AddrPort) error {
+			_, err := loop.WriteToAddrPort(data, addr)
+			return err
+		}},
+		{"WriteMsg", func(loop *eventLoop, data []byte, addr netip.AddrPort) error {
+			_, err := loop.WriteMsg(&Message{AddrPort: addr, Data: data})
+			return err
+		}},
+		{"WriteBatch", func(loop *eventLoop, data []byte, addr netip.AddrPort) error {
+			_, err := loop.WriteBatch([]Message{{AddrPort: addr, Data: data}})
+			return err
+		}},
+		{"flush", func(loop *eventLoop, data []byte, addr netip.AddrPort) error {
+			loop.Lock()
+			defer loop.Unlock()
+			if err := loop.push(netudp.Mmsg{Addr: addr, Data: data}); err != nil {
+				return err
+			}
+
+			loop.flush()
+			return nil
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.ListenerN = 1
+			config.Socket.RecvErr = true
+			svr := startServer(t, newEchoHandler(), config)
+			loop := testLoops(svr)[0]
+			dead := closedAddr(t)
+			peer := listenPeer(t)
+			addr := peer.LocalAddr().(*net.UDPAddr).AddrPort()
+
+			// on loopback the port unreachable of dead is pending once the
+			// write returns, before the event-loop reads the error queue
+			const n = 5
+			for i := 0; i < n; i++ {
+				loop.WriteToAddrPort([]byte("dead"), dead)
+				if err := tt.write(loop, []byte("live"), addr); err != nil {
+					t.Fatalf("write to a live peer after a dead one: %v", err)
+				}
+			}
+
+			if got := readPeer(t, peer, n); len(got) != n {
+				t.Fatalf("peer received %d datagrams, want %d", len(got), n)
+			}
+		})
+	}
+}
+
+func TestWriteBatchBehindQueue(t *testing.T) {
+	config := DefaultConfig()
+	config.ListenerN = 1
+	svr := startServer(t, newEchoHandler(), config)
+	loop := testLoops(svr)[0]
+	peer := listenPeer(t)
+	addr := peer.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	loop.Lock()
+	if err := loop.push(netudp.Mmsg{Addr: addr, Data: []byte("queued")}); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	loop.Unlock()
+
+	// the batch doesn't overtake the queue, whether it's flushed already or not
+	msgs := []Message{
+		{AddrPort: addr, Data: []byte("batch")},
+		{AddrPort: addr, Data: make([]byte, config.MTU+1)},
+	}
+	if n, err := loop.WriteBatch(msgs); n != 1 || err == nil {
+		t.Fatalf("WriteBatch() = %d, %v, want 1 and the error of the oversized message", n, err)
+	}
+
+	if msgs[0].Status != WriteSent && msgs[0].Status != WriteQueued {
+		t.Fatalf("status %v, want sent or queued", msgs[0].Status)
+	}
+
+	var pe *netudp.PeerError
+	if msgs[1].Status != WriteFailed || !errors.As(msgs[1].Err, &pe) || pe.Err != unix.EMSGSIZE || pe.Addr != addr {
+		t.Fatalf("oversized message: status %v, err %v, want an EMSGSIZE PeerError", msgs[1].Status, msgs[1].Err)
+	}
+
+	if got := readPeer(t, peer, 2); len(got) != 2 || got[0] != "queued" || got[1] != "batch" {
+		t.Fatalf("peer received %q, want the queued datagram first", got)
+	}
+}
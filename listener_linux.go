@@ -1,27 +1,111 @@
+//go:build linux
 // +build linux
 
 package fastudp
 
 import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
 	"github.com/shaoyuan1943/fastudp/netudp"
-	"golang.org/x/sys/unix"
 )
 
-type listener struct {
-	addr    unix.Sockaddr
-	fd      int
+// Listener is one address a Server listens on, it's served by Config.ListenerN
+// event-loops of its own.
+type Listener struct {
+	svr     *Server
 	network string
+	addr    netip.AddrPort
+	lb      loadBalancer
+	opts    netudp.SocketOptions
+	wg      sync.WaitGroup // running event-loops
+	removed atomic.Value
+}
+
+func newListener(svr *Server, network string) *Listener {
+	ln := &Listener{
+		svr:     svr,
+		network: network,
+		lb:      newLoadBalancer(&svr.config),
+	}
+	ln.removed.Store(false)
+	return ln
+}
+
+// Network returns the network the listener was added with.
+func (ln *Listener) Network() string {
+	return ln.network
+}
+
+// Addr returns the bound address, with the port picked by the kernel when
+// the listener was added with port 0.
+func (ln *Listener) Addr() netip.AddrPort {
+	return ln.addr
+}
+
+// SocketOptions returns the options of the sockets of ln as the kernel applied
+// them, see netudp.ReadSocketOptions.
+func (ln *Listener) SocketOptions() netudp.SocketOptions {
+	return ln.opts
+}
+
+// Listener returns ln, it implements Writer.
+func (ln *Listener) Listener() *Listener {
+	return ln
+}
+
+func (ln *Listener) String() string {
+	return ln.network + "/" + ln.addr.String()
+}
+
+// WriteTo sends data to addr from the address of ln, the event-loop is picked
+// by Config.LoadBalancing among the ones of ln.
+func (ln *Listener) WriteTo(data []byte, addr *net.UDPAddr) (int, error) {
+	if addr == nil {
+		return 0, fmt.Errorf("writeto: addr invalid")
+	}
+
+	return ln.WriteToAddrPort(data, netudp.AddrPortOf(addr))
+}
+
+// WriteToAddrPort is WriteTo with a netip.AddrPort, it doesn't allocate.
+func (ln *Listener) WriteToAddrPort(data []byte, addr netip.AddrPort) (int, error) {
+	loop, err := ln.svr.pick(ln, addr)
+	if err != nil {
+		return 0, err
+	}
+
+	return loop.WriteToAddrPort(data, addr)
+}
+
+// WriteMsgTo works like Writer.WriteMsgTo from the address of ln.
+func (ln *Listener) WriteMsgTo(data []byte, addr netip.AddrPort, src netip.Addr, ifIndex int) (int, error) {
+	loop, err := ln.svr.pick(ln, addr)
+	if err != nil {
+		return 0, err
+	}
+
+	return loop.WriteMsgTo(data, addr, src, ifIndex)
 }
 
-func listen(network, addr string, reusePort bool) (*listener, error) {
-	l := &listener{}
-	fd, sockaddr, err := netudp.NewUDPSocket(network, addr, reusePort)
+// WriteMsg works like Writer.WriteMsg from the address of ln.
+func (ln *Listener) WriteMsg(msg *Message) (int, error) {
+	loop, err := ln.svr.pick(ln, msg.addrPort())
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+
+	return loop.WriteMsg(msg)
+}
+
+// WriteBatch sends msgs from the address of ln like Server.WriteBatch does.
+func (ln *Listener) WriteBatch(msgs []Message) (int, error) {
+	if err := ln.svr.writable(ln); err != nil {
+		return 0, err
 	}
 
-	l.fd = fd
-	l.addr = sockaddr
-	l.network = network
-	return l, nil
+	return writeBatch(msgs, ln.lb.next)
 }
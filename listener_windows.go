@@ -0,0 +1,161 @@
+package fastudp
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/shaoyuan1943/fastudp/netudp"
+)
+
+// Listener is one address a Server listens on, it's served by a reader of its own.
+type Listener struct {
+	svr     *Server
+	network string
+	addr    netip.AddrPort
+	conn    *net.UDPConn
+	opts    netudp.SocketOptions
+	done    chan struct{} // closed when the reader has exited
+	removed atomic.Value
+	// buffer is the read buffer, it's replaced when a Packet is retained
+	buffer []byte
+}
+
+func newListener(svr *Server, network string, conn *net.UDPConn) *Listener {
+	ln := &Listener{
+		svr:     svr,
+		network: network,
+		addr:    netudp.AddrPortOf(conn.LocalAddr().(*net.UDPAddr)),
+		conn:    conn,
+		done:    make(chan struct{}),
+		buffer:  make([]byte, svr.config.MTU),
+	}
+	ln.removed.Store(false)
+	return ln
+}
+
+// readSocketOptions reads the options of the socket of ln into ln.opts.
+func (ln *Listener) readSocketOptions() error {
+	rc, err := ln.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	ln.opts, err = netudp.ReadSocketOptions(rc)
+	return err
+}
+
+// Network returns the network the listener was added with.
+func (ln *Listener) Network() string {
+	return ln.network
+}
+
+// Addr returns the bound address, with the port picked by the system when
+// the listener was added with port 0.
+func (ln *Listener) Addr() netip.AddrPort {
+	return ln.addr
+}
+
+// SocketOptions returns the options of the socket of ln as windows applied them,
+// see netudp.ReadSocketOptions.
+func (ln *Listener) SocketOptions() netudp.SocketOptions {
+	return ln.opts
+}
+
+// Listener returns ln, which is the Writer of the read callbacks on windows.
+func (ln *Listener) Listener() *Listener {
+	return ln
+}
+
+func (ln *Listener) String() string {
+	return ln.network + "/" + ln.addr.String()
+}
+
+// read reads conn until it's closed.
+func (ln *Listener) read() {
+	defer ln.svr.listenerClosed(ln)
+
+	h := ln.svr.handlers
+	for {
+		buffer := ln.buffer
+		n, remoteAddr, err := ln.conn.ReadFromUDPAddrPort(buffer)
+		if err != nil {
+			if !ln.svr.IsClosed() && !ln.removed.Load().(bool) {
+				ln.svr.readFailed(err)
+			}
+			return
+		}
+
+		if n > 0 {
+			remoteAddr = netip.AddrPortFrom(remoteAddr.Addr().Unmap(), remoteAddr.Port())
+			p := ln.svr.packetPool.Get().(*Packet)
+			p.data = buffer[:n]
+			p.addr = remoteAddr
+			p.ln = ln
+			p.owner = ln
+			p.refs = 1
+			if ln.svr.dispatcher != nil {
+				p.own()
+				ln.svr.dispatcher.dispatch(p, ln)
+			} else {
+				h.handlePacket(p, ln)
+				p.Release()
+			}
+		}
+	}
+}
+
+func (ln *Listener) detach(p *Packet) []byte {
+	buf := ln.buffer
+	ln.buffer = make([]byte, ln.svr.config.MTU)
+	return buf
+}
+
+func (ln *Listener) recycle(p *Packet) {
+	p.reset()
+	ln.svr.packetPool.Put(p)
+}
+
+// WriteTo sends data to addr from the address of ln.
+func (ln *Listener) WriteTo(data []byte, addr *net.UDPAddr) (int, error) {
+	if addr == nil {
+		return 0, fmt.Errorf("writeto: addr invalid")
+	}
+
+	return ln.WriteToAddrPort(data, netudp.AddrPortOf(addr))
+}
+
+// WriteToAddrPort is WriteTo with a netip.AddrPort.
+func (ln *Listener) WriteToAddrPort(data []byte, addr netip.AddrPort) (int, error) {
+	if ln.svr.IsClosed() {
+		return 0, fmt.Errorf("server is closed")
+	}
+
+	if ln.removed.Load().(bool) {
+		return 0, fmt.Errorf("listener removed")
+	}
+
+	// an IPv4 socket doesn't take v4-mapped addresses, a dual-stack one maps IPv4 itself
+	return ln.conn.WriteToUDPAddrPort(data, netudp.UnmapAddrPort(addr))
+}
+
+// WriteMsgTo is WriteToAddrPort, src and ifIndex are ignored on windows.
+func (ln *Listener) WriteMsgTo(data []byte, addr netip.AddrPort, src netip.Addr, ifIndex int) (int, error) {
+	return ln.WriteToAddrPort(data, addr)
+}
+
+// WriteMsg sends msg to its address, its other options are ignored on windows.
+func (ln *Listener) WriteMsg(msg *Message) (int, error) {
+	n, err := ln.WriteToAddrPort(msg.Data, msg.addrPort())
+	if err == nil {
+		msg.sent()
+	}
+
+	return n, err
+}
+
+// WriteBatch writes msgs one by one, there is no sendmmsg on windows.
+func (ln *Listener) WriteBatch(msgs []Message) (int, error) {
+	return writeBatch(msgs, ln.WriteToAddrPort)
+}
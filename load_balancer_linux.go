@@ -0,0 +1,187 @@
+//go:build linux
+// +build linux
+
+package fastudp
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/shaoyuan1943/fastudp/netudp"
+)
+
+type loadBalancer interface {
+	register(loop *eventLoop)
+	unregister(loop *eventLoop)
+	// observe is called by loop for every datagram it receives from addr.
+	observe(loop *eventLoop, addr netip.AddrPort)
+	// lookup returns the event-loop which last received from addr, nil when
+	// the balancer doesn't track peers.
+	lookup(addr netip.AddrPort) *eventLoop
+	next(addr netip.AddrPort) *eventLoop
+	len() int
+}
+
+func newLoadBalancer(config *Config) loadBalancer {
+	switch config.LoadBalancing {
+	case RoundRobin:
+		return &roundRobinLoadBalancer{}
+	case LeastQueued:
+		return &leastQueuedLoadBalancer{}
+	case PeerHash:
+		return &peerHashLoadBalancer{}
+	}
+
+	return &peerAffinityLoadBalancer{
+		peers: make(map[netip.AddrPort]*eventLoop),
+		limit: config.PeerTableSize,
+	}
+}
+
+type loopSet struct {
+	loops []*eventLoop
+	sync.RWMutex
+}
+
+func (set *loopSet) register(loop *eventLoop) {
+	set.Lock()
+	defer set.Unlock()
+
+	set.loops = append(set.loops, loop)
+}
+
+func (set *loopSet) unregister(loop *eventLoop) {
+	set.Lock()
+	defer set.Unlock()
+
+	for i, l := range set.loops {
+		if l == loop {
+			set.loops = append(set.loops[:i], set.loops[i+1:]...)
+			return
+		}
+	}
+}
+
+func (set *loopSet) observe(loop *eventLoop, addr netip.AddrPort) {}
+
+func (set *loopSet) lookup(addr netip.AddrPort) *eventLoop {
+	return nil
+}
+
+func (set *loopSet) len() int {
+	set.RLock()
+	defer set.RUnlock()
+
+	return len(set.loops)
+}
+
+type roundRobinLoadBalancer struct {
+	loopSet
+	nextIndex uint32
+}
+
+func (lb *roundRobinLoadBalancer) next(addr netip.AddrPort) *eventLoop {
+	lb.RLock()
+	defer lb.RUnlock()
+
+	if len(lb.loops) == 0 {
+		return nil
+	}
+
+	i := atomic.AddUint32(&lb.nextIndex, 1)
+	return lb.loops[int(i%uint32(len(lb.loops)))]
+}
+
+type leastQueuedLoadBalancer struct {
+	loopSet
+}
+
+func (lb *leastQueuedLoadBalancer) next(addr netip.AddrPort) *eventLoop {
+	lb.RLock()
+	defer lb.RUnlock()
+
+	var loop *eventLoop
+	least := -1
+	for _, l := range lb.loops {
+		n := l.queueLen()
+		if least < 0 || n < least {
+			loop, least = l, n
+		}
+
+		if least == 0 {
+			break
+		}
+	}
+
+	return loop
+}
+
+type peerHashLoadBalancer struct {
+	loopSet
+}
+
+func (lb *peerHashLoadBalancer) next(addr netip.AddrPort) *eventLoop {
+	lb.RLock()
+	defer lb.RUnlock()
+
+	if len(lb.loops) == 0 {
+		return nil
+	}
+
+	return lb.loops[int(peerHash(addr)%uint32(len(lb.loops)))]
+}
+
+type peerAffinityLoadBalancer struct {
+	peerHashLoadBalancer
+	peersMu sync.RWMutex
+	peers   map[netip.AddrPort]*eventLoop
+	limit   int
+}
+
+func (lb *peerAffinityLoadBalancer) unregister(loop *eventLoop) {
+	lb.peerHashLoadBalancer.unregister(loop)
+
+	lb.peersMu.Lock()
+	defer lb.peersMu.Unlock()
+
+	for key, l := range lb.peers {
+		if l == loop {
+			delete(lb.peers, key)
+		}
+	}
+}
+
+func (lb *peerAffinityLoadBalancer) observe(loop *eventLoop, addr netip.AddrPort) {
+	lb.peersMu.RLock()
+	l, ok := lb.peers[addr]
+	lb.peersMu.RUnlock()
+	if ok && l == loop {
+		return
+	}
+
+	lb.peersMu.Lock()
+	defer lb.peersMu.Unlock()
+
+	if len(lb.peers) >= lb.limit {
+		lb.peers = make(map[netip.AddrPort]*eventLoop)
+	}
+
+	lb.peers[addr] = loop
+}
+
+func (lb *peerAffinityLoadBalancer) lookup(addr netip.AddrPort) *eventLoop {
+	lb.peersMu.RLock()
+	defer lb.peersMu.RUnlock()
+
+	// peers are observed unmapped
+	return lb.peers[netudp.UnmapAddrPort(addr)]
+}
+
+func (lb *peerAffinityLoadBalancer) next(addr netip.AddrPort) *eventLoop {
+	if loop := lb.lookup(addr); loop != nil {
+		return loop
+	}
+
+	return lb.peerHashLoadBalancer.next(addr)
+}
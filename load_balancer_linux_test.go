@@ -0,0 +1,202 @@
+//go:build linux
+// +build linux
+
+package fastudp
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/shaoyuan1943/fastudp/netudp"
+)
+
+// newTestLoops returns n event-loops which only carry a write queue.
+func newTestLoops(n int) []*eventLoop {
+	loops := make([]*eventLoop, n)
+	for i := range loops {
+		loops[i] = &eventLoop{}
+	}
+	return loops
+}
+
+func newTestLoadBalancer(lb LoadBalancing, loops []*eventLoop) loadBalancer {
+	config := Config{LoadBalancing: lb}
+	config.setDefaults()
+	b := newLoadBalancer(&config)
+	for _, loop := range loops {
+		b.register(loop)
+	}
+	return b
+}
+
+func TestLoadBalancerEmpty(t *testing.T) {
+	addr := netip.MustParseAddrPort("10.0.0.1:53")
+	for _, lb := range []LoadBalancing{PeerAffinity, RoundRobin, LeastQueued, PeerHash} {
+		if loop := newTestLoadBalancer(lb, nil).next(addr); loop != nil {
+			t.Errorf("%v: next without event-loops = %p, want nil", lb, loop)
+		}
+	}
+}
+
+func TestRoundRobinLoadBalancer(t *testing.T) {
+	loops := newTestLoops(3)
+	lb := newTestLoadBalancer(RoundRobin, loops)
+	addr := netip.MustParseAddrPort("10.0.0.1:53")
+
+	seen := make(map[*eventLoop]int)
+	for i := 0; i < 3*len(loops); i++ {
+		seen[lb.next(addr)]++
+	}
+
+	for i, loop := range loops {
+		if seen[loop] != 3 {
+			t.Errorf("event-loop %d picked %d times, want 3", i, seen[loop])
+		}
+	}
+
+	lb.unregister(loops[1])
+	for i := 0; i < 4; i++ {
+		if lb.next(addr) == loops[1] {
+			t.Fatal("next picked an unregistered event-loop")
+		}
+	}
+
+	if lb.len() != 2 {
+		t.Errorf("len() = %d, want 2", lb.len())
+	}
+}
+
+func TestLeastQueuedLoadBalancer(t *testing.T) {
+	loops := newTestLoops(3)
+	lb := newTestLoadBalancer(LeastQueued, loops)
+	addr := netip.MustParseAddrPort("10.0.0.1:53")
+
+	tests := []struct {
+		queued []int
+		want   int
+	}{
+		{[]int{0, 0, 0}, 0},
+		{[]int{2, 1, 3}, 1},
+		{[]int{2, 3, 1}, 2},
+		{[]int{1, 1, 2}, 0},
+	}
+
+	for _, tt := range tests {
+		for i, n := range tt.queued {
+			loops[i].writeQueue = make([]*netudp.Mmsg, n)
+		}
+
+		if loop := lb.next(addr); loop != loops[tt.want] {
+			t.Errorf("queued %v: next picked %p, want event-loop %d", tt.queued, loop, tt.want)
+		}
+	}
+}
+
+func TestPeerHashLoadBalancer(t *testing.T) {
+	loops := newTestLoops(4)
+	lb := newTestLoadBalancer(PeerHash, loops)
+
+	for _, s := range []string{"10.0.0.1:53", "10.0.0.2:4242", "[2001:db8::1]:443"} {
+		addr := netip.MustParseAddrPort(s)
+		want := loops[peerHash(addr)%uint32(len(loops))]
+		for i := 0; i < 3; i++ {
+			if loop := lb.next(addr); loop != want {
+				t.Fatalf("next(%v) = %p, want %p", addr, loop, want)
+			}
+		}
+	}
+}
+
+func TestPeerAffinityLoadBalancer(t *testing.T) {
+	loops := newTestLoops(4)
+	config := Config{PeerTableSize: 2}
+	config.setDefaults()
+	lb := newLoadBalancer(&config)
+	for _, loop := range loops {
+		lb.register(loop)
+	}
+
+	a := netip.MustParseAddrPort("10.0.0.1:53")
+	b := netip.MustParseAddrPort("10.0.0.2:53")
+	c := netip.MustParseAddrPort("10.0.0.3:53")
+
+	if loop := lb.lookup(a); loop != nil {
+		t.Fatalf("lookup of an unknown peer = %p, want nil", loop)
+	}
+
+	if loop, want := lb.next(a), loops[peerHash(a)%4]; loop != want {
+		t.Fatalf("next of an unknown peer = %p, want the PeerHash pick %p", loop, want)
+	}
+
+	lb.observe(loops[3], a)
+	if loop := lb.next(a); loop != loops[3] {
+		t.Fatalf("next(%v) = %p, want the event-loop which received from it", a, loop)
+	}
+
+	// a peer written to through a dual-stack socket is observed unmapped
+	mapped := netip.AddrPortFrom(netip.AddrFrom16(a.Addr().As16()), a.Port())
+	if loop := lb.next(mapped); loop != loops[3] {
+		t.Fatalf("next(%v) = %p, want the event-loop of %v", mapped, loop, a)
+	}
+
+	lb.observe(loops[2], a)
+	if loop := lb.next(a); loop != loops[2] {
+		t.Fatalf("next(%v) after it moved = %p, want %p", a, loop, loops[2])
+	}
+
+	// the table is reset once it holds PeerTableSize peers
+	lb.observe(loops[1], b)
+	lb.observe(loops[1], c)
+	if loop := lb.lookup(a); loop != nil {
+		t.Fatalf("lookup(%v) after the reset = %p, want nil", a, loop)
+	}
+
+	if loop := lb.lookup(c); loop != loops[1] {
+		t.Fatalf("lookup(%v) = %p, want %p", c, loop, loops[1])
+	}
+
+	lb.unregister(loops[1])
+	if loop := lb.lookup(c); loop != nil {
+		t.Fatalf("lookup(%v) after its event-loop was unregistered = %p, want nil", c, loop)
+	}
+
+	if loop := lb.next(c); loop == loops[1] {
+		t.Fatal("next picked an unregistered event-loop")
+	}
+}
+
+func TestServerNext(t *testing.T) {
+	svr := startServer(t, newEchoHandler(), DefaultConfig())
+	ln, err := svr.AddListener("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("AddListener: %v", err)
+	}
+
+	other, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer other.Close()
+
+	peer := other.LocalAddr().(*net.UDPAddr).AddrPort()
+	if loop := svr.next(peer); loop == nil || loop.ln != svr.Listeners()[0] {
+		t.Fatal("next of an unknown peer isn't an event-loop of the first listener")
+	}
+
+	// the peer is sent to from the listener which received from it
+	if _, err := other.WriteToUDPAddrPort([]byte("ping"), ln.Addr()); err != nil {
+		t.Fatalf("WriteToUDPAddrPort: %v", err)
+	}
+
+	buf := make([]byte, 16)
+	other.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := other.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	if loop := svr.next(peer); loop == nil || loop.ln != ln {
+		t.Fatal("next of a peer the second listener received from isn't an event-loop of it")
+	}
+}
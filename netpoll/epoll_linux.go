@@ -1,3 +1,4 @@
+//go:build linux
 // +build linux
 
 package netpoll
@@ -6,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"sync/atomic"
 
 	"golang.org/x/sys/unix"
 )
@@ -18,7 +20,9 @@ const (
 )
 
 type Poller struct {
-	fd int
+	fd       int
+	wfd      int // eventfd used to wake up Polling
+	shutdown int32
 }
 
 func PollerInit() (*Poller, error) {
@@ -27,8 +31,21 @@ func PollerInit() (*Poller, error) {
 		return nil, os.NewSyscallError("epoll_create1", err)
 	}
 
+	wfd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("eventfd", err)
+	}
+
 	poller := &Poller{
-		fd: fd,
+		fd:  fd,
+		wfd: wfd,
+	}
+
+	if err := poller.Add(wfd, "r"); err != nil {
+		unix.Close(wfd)
+		unix.Close(fd)
+		return nil, err
 	}
 
 	return poller, nil
@@ -46,6 +63,9 @@ func (poller *Poller) Add(fd int, ev string) error {
 		e.Events = unix.EPOLLOUT | unix.EPOLLET
 	case "rw":
 		e.Events = unix.EPOLLIN | unix.EPOLLOUT | unix.EPOLLET
+	case "e":
+		// EPOLLERR and EPOLLHUP are always reported
+		e.Events = unix.EPOLLET
 	default:
 		return fmt.Errorf("unknow epoll event type")
 	}
@@ -65,6 +85,9 @@ func (poller *Poller) Mod(fd int, ev string) error {
 		e.Events = unix.EPOLLOUT | unix.EPOLLET
 	case "rw":
 		e.Events = unix.EPOLLIN | unix.EPOLLOUT | unix.EPOLLET
+	case "e":
+		// EPOLLERR and EPOLLHUP are always reported
+		e.Events = unix.EPOLLET
 	default:
 		return fmt.Errorf("unknow epoll event type")
 	}
@@ -76,7 +99,21 @@ func (poller *Poller) Del(fd int) error {
 	return os.NewSyscallError("epoll_ctl del", unix.EpollCtl(poller.fd, unix.EPOLL_CTL_DEL, fd, nil))
 }
 
+// Shutdown makes Polling return nil, it's safe to call from any goroutine.
+func (poller *Poller) Shutdown() error {
+	if !atomic.CompareAndSwapInt32(&poller.shutdown, 0, 1) {
+		return nil
+	}
+
+	var b [8]byte
+	b[0] = 1
+	_, err := unix.Write(poller.wfd, b[:])
+	return os.NewSyscallError("write", err)
+}
+
+// Close releases the poller, it must be called after Polling has returned.
 func (poller *Poller) Close() error {
+	unix.Close(poller.wfd)
 	return os.NewSyscallError("close", unix.Close(poller.fd))
 }
 
@@ -100,6 +137,14 @@ func (poller *Poller) Polling(eventHandler func(fd int32, ev uint32)) error {
 
 		msec = 0
 		for i := 0; i < n; i++ {
+			if int(evs[i].Fd) == poller.wfd {
+				if atomic.LoadInt32(&poller.shutdown) == 1 {
+					return nil
+				}
+
+				continue
+			}
+
 			eventHandler(evs[i].Fd, evs[i].Events)
 		}
 	}
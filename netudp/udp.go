@@ -1,6 +1,178 @@
 package netudp
 
-import "strings"
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SocketOptions are applied to a socket between socket() and bind().
+type SocketOptions struct {
+	// ReusePort enables SO_REUSEPORT so that several sockets can bind the same address.
+	ReusePort bool
+	// ReadBuffer sets SO_RCVBUF, 0 keeps the kernel default. The kernel caps it to
+	// net.core.rmem_max and reports twice the size, for its bookkeeping.
+	ReadBuffer int
+	// WriteBuffer sets SO_SNDBUF, 0 keeps the kernel default.
+	WriteBuffer int
+	// ForceBuffers sets ReadBuffer and WriteBuffer with SO_RCVBUFFORCE and
+	// SO_SNDBUFFORCE, which aren't capped but need CAP_NET_ADMIN. Without it
+	// the capped options are used.
+	ForceBuffers bool
+	// Priority sets SO_PRIORITY, the queueing priority of the datagrams sent,
+	// values above 6 need CAP_NET_ADMIN.
+	Priority int
+	// Mark sets SO_MARK, the fwmark used for routing and filtering, it needs
+	// CAP_NET_ADMIN.
+	Mark int
+	// BindToDevice sets SO_BINDTODEVICE, the socket only receives from and sends
+	// through the named interface.
+	BindToDevice string
+	// FreeBind sets IP_FREEBIND, the socket can be bound to an address which
+	// isn't configured yet.
+	FreeBind bool
+	// BusyPoll sets SO_BUSY_POLL, how long a read busy polls the device queue
+	// when there is nothing to read, in microseconds.
+	BusyPoll time.Duration
+	// Timestamps enables SO_TIMESTAMPNS, the time the kernel received every
+	// datagram is reported in ControlMessage.Timestamp.
+	Timestamps bool
+	// TOS sets IP_TOS and IPV6_TCLASS, the DSCP and ECN bits of every datagram
+	// sent without a TOS of its own, 0 keeps the kernel default.
+	TOS int
+	// RecvTOS enables IP_RECVTOS and IPV6_RECVTCLASS, the TOS byte of every
+	// datagram is reported in ControlMessage.TOS.
+	RecvTOS bool
+	// TTL sets IP_TTL and IPV6_UNICAST_HOPS, the TTL or hop limit of every
+	// datagram sent without a TTL of its own, 0 keeps the kernel default.
+	TTL int
+	// RecvTTL enables IP_RECVTTL and IPV6_RECVHOPLIMIT, the TTL or hop limit of
+	// every datagram is reported in ControlMessage.TTL.
+	RecvTTL bool
+	// RecvDrops enables SO_RXQ_OVFL, the number of datagrams the kernel dropped
+	// so far because the receive queue was full is reported in ControlMessage.Drops.
+	RecvDrops bool
+	// RecvErr enables IP_RECVERR and IPV6_RECVERR, the errors reported for the
+	// datagrams sent, such as ICMP port unreachable, are queued on the socket
+	// with the address of the peer, see PeerError.
+	RecvErr bool
+	// V6Only sets IPV6_V6ONLY of IPv6 sockets, whether they also serve IPv4 as
+	// v4-mapped addresses. Ignored on windows.
+	V6Only V6Only
+	// PMTUDiscovery sets IP_MTU_DISCOVER and IPV6_MTU_DISCOVER, PMTUDiscoveryDefault
+	// keeps the kernel default.
+	PMTUDiscovery PMTUDiscovery
+	// Control is called with the raw socket after the options above are set and
+	// before bind(2) or connect(2), like net.ListenConfig.Control, to set options
+	// missing above. An error fails the socket.
+	Control func(network, address string, c syscall.RawConn) error
+}
+
+// V6Only decides whether an IPv6 socket is dual-stack.
+type V6Only int
+
+const (
+	// V6OnlyDefault makes the socket of the "udp" network for a wildcard address
+	// dual-stack, like the net package does, and the one of "udp6" IPv6-only.
+	// A "udp" socket falls back to IPv4 when the host has no IPv6.
+	V6OnlyDefault V6Only = iota
+	// V6OnlyOn makes every IPv6 socket IPv6-only.
+	V6OnlyOn
+	// V6OnlyOff makes every IPv6 socket dual-stack.
+	V6OnlyOff
+)
+
+// PMTUDiscovery is the path MTU discovery mode of a socket, it decides whether
+// datagrams are sent with the DF bit and how EMSGSIZE is raised.
+type PMTUDiscovery int
+
+const (
+	// PMTUDiscoveryDefault keeps the mode of net.ipv4.ip_no_pmtu_disc.
+	PMTUDiscoveryDefault PMTUDiscovery = iota
+	// PMTUDiscoveryDont never sets DF, datagrams larger than the path MTU are
+	// fragmented.
+	PMTUDiscoveryDont
+	// PMTUDiscoveryWant sets DF and fragments datagrams larger than the known
+	// path MTU.
+	PMTUDiscoveryWant
+	// PMTUDiscoveryDo sets DF and fails datagrams larger than the known path MTU
+	// with EMSGSIZE, the application re-segments them.
+	PMTUDiscoveryDo
+	// PMTUDiscoveryProbe sets DF and ignores the known path MTU, it's used to
+	// send probes larger than it, the interface MTU still applies.
+	PMTUDiscoveryProbe
+)
+
+// ControlMessage is the ancillary data received with a datagram.
+type ControlMessage struct {
+	// SegmentSize is the size of the datagrams UDP_GRO coalesced into the
+	// buffer the datagram was split from, 0 when it was not coalesced.
+	SegmentSize int
+	// Dst is the local address the datagram was sent to, IfIndex the interface
+	// it arrived on. They are only set when pktinfo is enabled.
+	Dst     netip.Addr
+	IfIndex int
+	// Timestamp is the time the kernel received the datagram, it's only set
+	// with SocketOptions.Timestamps.
+	Timestamp time.Time
+	// TOS is the TOS byte or IPv6 traffic class of the datagram, its ECN bits
+	// are TOS&0x3. It's only set with SocketOptions.RecvTOS.
+	TOS int
+	// TTL is the TTL or hop limit of the datagram, it's only set with
+	// SocketOptions.RecvTTL.
+	TTL int
+	// Drops is the number of datagrams the socket dropped before this one was
+	// queued, it wraps around. It's only set with SocketOptions.RecvDrops once
+	// drops happened.
+	Drops uint32
+}
+
+// PeerError is an error the kernel queued for a datagram sent to Addr, such as
+// an ICMP port unreachable, see SocketOptions.RecvErr.
+type PeerError struct {
+	// Addr is the destination of the datagram which caused the error, the kernel
+	// leaves its port 0 for an EMSGSIZE raised locally on an unconnected socket.
+	Addr netip.AddrPort
+	// Offender is the node which reported the error, such as a router, it's
+	// invalid for errors raised by the local host.
+	Offender netip.Addr
+	// Err is the errno, such as ECONNREFUSED, EHOSTUNREACH or EMSGSIZE.
+	Err error
+	// Origin is the SO_EE_ORIGIN_* of the error, Type and Code are the ICMP
+	// type and code of ICMP errors.
+	Origin int
+	Type   int
+	Code   int
+	// Info is the MTU of the path for EMSGSIZE, 0 when it isn't known.
+	Info uint32
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("peer %v: %v", e.Addr, e.Err)
+}
+
+func (e *PeerError) Unwrap() error {
+	return e.Err
+}
+
+// MaxPayload returns the largest UDP payload to addr which fits in mtu, e.g. a
+// MTU from PathMTU or PeerError.Info.
+func MaxPayload(addr netip.AddrPort, mtu int) int {
+	// IP header without options and UDP header
+	header := 40 + 8
+	if addr.Addr().Unmap().Is4() {
+		header = 20 + 8
+	}
+
+	if mtu <= header {
+		return 0
+	}
+
+	return mtu - header
+}
 
 func IsUDP(network string) bool {
 	switch strings.ToLower(network) {
@@ -10,3 +182,20 @@ func IsUDP(network string) bool {
 
 	return false
 }
+
+// UnmapAddrPort turns an IPv4-mapped IPv6 address into the IPv4 one, which
+// is how the peers of dual-stack sockets are reported.
+func UnmapAddrPort(addr netip.AddrPort) netip.AddrPort {
+	if !addr.Addr().Is4In6() {
+		return addr
+	}
+
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
+
+// AddrPortOf converts addr to a netip.AddrPort, IPv4-mapped IPv6 addresses
+// are unmapped so that they are sent as IPv4.
+func AddrPortOf(addr *net.UDPAddr) netip.AddrPort {
+	ip, _ := netip.AddrFromSlice(addr.IP)
+	return netip.AddrPortFrom(ip.Unmap().WithZone(addr.Zone), uint16(addr.Port))
+}
@@ -0,0 +1,114 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import (
+	"net/netip"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// addControl grows the control buffer of every read slot by space bytes, a
+// CmsgSpace of the cmsg an option enabled on the socket adds to each datagram.
+func (rw *ReaderWriter) addControl(space int) {
+	rw.controlSpace += space
+	for i := range rw.msgs {
+		rw.controls[i] = make([]byte, rw.controlSpace)
+		rw.msgs[i].Hdr.Control = &rw.controls[i][0]
+		rw.msgs[i].Hdr.Controllen = uint64(rw.controlSpace)
+	}
+}
+
+// Control returns the ancillary data of the datagram being delivered, it must
+// only be used from inside the read callback.
+func (rw *ReaderWriter) Control() *ControlMessage {
+	return &rw.cm
+}
+
+// Drops returns the latest drop count of the socket, see ControlMessage.Drops.
+func (rw *ReaderWriter) Drops() uint32 {
+	return rw.drops
+}
+
+// control returns the cmsgs received in slot i.
+func (rw *ReaderWriter) control(i int) []byte {
+	if rw.controlSpace == 0 {
+		return nil
+	}
+
+	return rw.controls[i][:rw.msgs[i].Hdr.Controllen]
+}
+
+// parseControl decodes the cmsgs b of a datagram into cm.
+func (rw *ReaderWriter) parseControl(b []byte, cm *ControlMessage) {
+	*cm = ControlMessage{}
+	for len(b) >= unix.SizeofCmsghdr {
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+		if h.Len < unix.SizeofCmsghdr || int(h.Len) > len(b) {
+			return
+		}
+
+		data := b[unix.CmsgLen(0):h.Len]
+		switch {
+		case h.Level == unix.IPPROTO_UDP && h.Type == udpGRO && len(data) >= 4:
+			cm.SegmentSize = int(*(*int32)(unsafe.Pointer(&data[0])))
+		case h.Level == unix.SOL_SOCKET && h.Type == unix.SCM_TIMESTAMPNS && len(data) >= int(unsafe.Sizeof(unix.Timespec{})):
+			ts := (*unix.Timespec)(unsafe.Pointer(&data[0]))
+			cm.Timestamp = time.Unix(ts.Unix())
+		case h.Level == unix.SOL_SOCKET && h.Type == unix.SO_RXQ_OVFL && len(data) >= 4:
+			cm.Drops = *(*uint32)(unsafe.Pointer(&data[0]))
+			// datagrams of a batch may be delivered out of queueing order
+			if int32(cm.Drops-rw.drops) > 0 {
+				rw.drops = cm.Drops
+			}
+		case h.Level == unix.IPPROTO_IP && h.Type == unix.IP_TOS && len(data) >= 1:
+			cm.TOS = int(data[0])
+		case h.Level == unix.IPPROTO_IPV6 && h.Type == unix.IPV6_TCLASS && len(data) >= 4:
+			cm.TOS = int(*(*int32)(unsafe.Pointer(&data[0])))
+		case h.Level == unix.IPPROTO_IP && h.Type == unix.IP_TTL && len(data) >= 4:
+			cm.TTL = int(*(*int32)(unsafe.Pointer(&data[0])))
+		case h.Level == unix.IPPROTO_IPV6 && h.Type == unix.IPV6_HOPLIMIT && len(data) >= 4:
+			cm.TTL = int(*(*int32)(unsafe.Pointer(&data[0])))
+		case h.Level == unix.IPPROTO_IP && h.Type == unix.IP_PKTINFO && len(data) >= unix.SizeofInet4Pktinfo:
+			info := (*unix.Inet4Pktinfo)(unsafe.Pointer(&data[0]))
+			cm.Dst = netip.AddrFrom4(info.Addr)
+			cm.IfIndex = int(info.Ifindex)
+		case h.Level == unix.IPPROTO_IPV6 && h.Type == unix.IPV6_PKTINFO && len(data) >= unix.SizeofInet6Pktinfo:
+			info := (*unix.Inet6Pktinfo)(unsafe.Pointer(&data[0]))
+			cm.Dst = netip.AddrFrom16(info.Addr).Unmap()
+			cm.IfIndex = int(info.Ifindex)
+		}
+
+		space := unix.CmsgSpace(int(h.Len) - unix.CmsgLen(0))
+		if space >= len(b) {
+			return
+		}
+		b = b[space:]
+	}
+}
+
+// sendControlSpace is the room putControl needs for one message.
+var sendControlSpace = unix.CmsgSpace(2) + unix.CmsgSpace(unix.SizeofInet6Pktinfo) + 2*unix.CmsgSpace(4)
+
+// hasControl reports whether msg needs cmsgs besides a segment size.
+func (msg *Mmsg) hasControl() bool {
+	return msg.Src.IsValid() || msg.IfIndex != 0 || msg.TOS != 0 || msg.TTL != 0
+}
+
+// putControl stores the cmsgs of msg into b, with a UDP_SEGMENT one when
+// segment isn't 0, and returns their length.
+func putControl(b []byte, msg *Mmsg, segment int) int {
+	l := 0
+	if segment > 0 {
+		putSegmentSize(b, segment)
+		l = unix.CmsgSpace(2)
+	}
+
+	l += putPktinfo(b[l:], msg.Addr, msg.Src, msg.IfIndex)
+	l += putIPCmsg(b[l:], msg.Addr, optTOS, msg.TOS)
+	l += putIPCmsg(b[l:], msg.Addr, cmsgTTL, msg.TTL)
+	return l
+}
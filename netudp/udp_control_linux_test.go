@@ -0,0 +1,248 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// cmsgBuilder appends cmsgs the way the kernel lays them out.
+type cmsgBuilder []byte
+
+func (b *cmsgBuilder) add(level, typ int, data []byte) *cmsgBuilder {
+	c := make([]byte, unix.CmsgSpace(len(data)))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&c[0]))
+	h.Level, h.Type = int32(level), int32(typ)
+	h.SetLen(unix.CmsgLen(len(data)))
+	copy(c[unix.CmsgLen(0):], data)
+	*b = append(*b, c...)
+	return b
+}
+
+func (b *cmsgBuilder) addInt(level, typ int, v int32) *cmsgBuilder {
+	return b.add(level, typ, (*[4]byte)(unsafe.Pointer(&v))[:])
+}
+
+// findCmsg returns the data of the cmsg level/typ of b, nil when it's missing.
+func findCmsg(t *testing.T, b []byte, level, typ int) []byte {
+	t.Helper()
+	cmsgs, err := unix.ParseSocketControlMessage(b)
+	if err != nil {
+		t.Fatalf("ParseSocketControlMessage: %v", err)
+	}
+
+	for _, c := range cmsgs {
+		if c.Header.Level == int32(level) && c.Header.Type == int32(typ) {
+			return c.Data
+		}
+	}
+	return nil
+}
+
+func TestParseControl(t *testing.T) {
+	ts := unix.NsecToTimespec(time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC).UnixNano())
+	pkt4 := unix.Inet4Pktinfo{Ifindex: 3, Addr: [4]byte{192, 0, 2, 1}}
+	pkt6 := unix.Inet6Pktinfo{Ifindex: 4, Addr: netip.MustParseAddr("2001:db8::1").As16()}
+	mapped := unix.Inet6Pktinfo{Ifindex: 5, Addr: netip.MustParseAddr("::ffff:192.0.2.2").As16()}
+
+	tests := []struct {
+		name string
+		b    *cmsgBuilder
+		want ControlMessage
+	}{
+		{"empty", &cmsgBuilder{}, ControlMessage{}},
+		{"GRO", new(cmsgBuilder).addInt(unix.IPPROTO_UDP, udpGRO, 1200), ControlMessage{SegmentSize: 1200}},
+		{"timestamp", new(cmsgBuilder).add(unix.SOL_SOCKET, unix.SCM_TIMESTAMPNS, (*[unsafe.Sizeof(ts)]byte)(unsafe.Pointer(&ts))[:]),
+			ControlMessage{Timestamp: time.Unix(ts.Unix())}},
+		// the kernel reports the received IP_TOS as a byte
+		{"IP_TOS", new(cmsgBuilder).add(unix.IPPROTO_IP, unix.IP_TOS, []byte{0xb9}), ControlMessage{TOS: 0xb9}},
+		{"IPV6_TCLASS", new(cmsgBuilder).addInt(unix.IPPROTO_IPV6, unix.IPV6_TCLASS, 0x2e), ControlMessage{TOS: 0x2e}},
+		{"IP_TTL", new(cmsgBuilder).addInt(unix.IPPROTO_IP, unix.IP_TTL, 64), ControlMessage{TTL: 64}},
+		{"IPV6_HOPLIMIT", new(cmsgBuilder).addInt(unix.IPPROTO_IPV6, unix.IPV6_HOPLIMIT, 255), ControlMessage{TTL: 255}},
+		{"IP_PKTINFO", new(cmsgBuilder).add(unix.IPPROTO_IP, unix.IP_PKTINFO, (*[unix.SizeofInet4Pktinfo]byte)(unsafe.Pointer(&pkt4))[:]),
+			ControlMessage{Dst: netip.MustParseAddr("192.0.2.1"), IfIndex: 3}},
+		{"IPV6_PKTINFO", new(cmsgBuilder).add(unix.IPPROTO_IPV6, unix.IPV6_PKTINFO, (*[unix.SizeofInet6Pktinfo]byte)(unsafe.Pointer(&pkt6))[:]),
+			ControlMessage{Dst: netip.MustParseAddr("2001:db8::1"), IfIndex: 4}},
+		{"IPV6_PKTINFO of an IPv4 datagram", new(cmsgBuilder).add(unix.IPPROTO_IPV6, unix.IPV6_PKTINFO, (*[unix.SizeofInet6Pktinfo]byte)(unsafe.Pointer(&mapped))[:]),
+			ControlMessage{Dst: netip.MustParseAddr("192.0.2.2"), IfIndex: 5}},
+		{"all", new(cmsgBuilder).
+			addInt(unix.IPPROTO_UDP, udpGRO, 500).
+			add(unix.IPPROTO_IP, unix.IP_TOS, []byte{2}).
+			addInt(unix.IPPROTO_IP, unix.IP_TTL, 7).
+			addInt(unix.SOL_SOCKET, unix.SO_RXQ_OVFL, 9),
+			ControlMessage{SegmentSize: 500, TOS: 2, TTL: 7, Drops: 9}},
+		{"unknown cmsg skipped", new(cmsgBuilder).addInt(unix.SOL_SOCKET, unix.SO_MARK, 1).addInt(unix.IPPROTO_IP, unix.IP_TTL, 3),
+			ControlMessage{TTL: 3}},
+		{"short data ignored", new(cmsgBuilder).add(unix.IPPROTO_IP, unix.IP_TTL, []byte{1, 2}), ControlMessage{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := &ReaderWriter{}
+			cm := ControlMessage{TTL: -1, Dst: netip.MustParseAddr("10.0.0.1")}
+			rw.parseControl(*tt.b, &cm)
+			if cm != tt.want {
+				t.Fatalf("parseControl() = %+v, want %+v", cm, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseControlMalformed(t *testing.T) {
+	b := *new(cmsgBuilder).addInt(unix.IPPROTO_IP, unix.IP_TTL, 64).addInt(unix.IPPROTO_IP, unix.IP_TOS, 1)
+	rw := &ReaderWriter{}
+	for _, tt := range []struct {
+		name string
+		b    []byte
+	}{
+		{"truncated header", b[:unix.SizeofCmsghdr-1]},
+		{"truncated data", b[:unix.CmsgLen(2)]},
+		{"length too small", func() []byte {
+			c := append([]byte(nil), b...)
+			(*unix.Cmsghdr)(unsafe.Pointer(&c[0])).Len = 1
+			return c
+		}()},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var cm ControlMessage
+			rw.parseControl(tt.b, &cm)
+			if cm != (ControlMessage{}) {
+				t.Fatalf("parseControl() = %+v, want nothing decoded", cm)
+			}
+		})
+	}
+}
+
+func TestPutControl(t *testing.T) {
+	v4 := netip.MustParseAddrPort("192.0.2.1:53")
+	v6 := netip.MustParseAddrPort("[2001:db8::1]:53")
+	mapped := netip.MustParseAddrPort("[::ffff:192.0.2.1]:53")
+
+	tests := []struct {
+		name    string
+		msg     Mmsg
+		segment int
+		space   int
+	}{
+		{"none", Mmsg{Addr: v4}, 0, 0},
+		{"segment", Mmsg{Addr: v4}, 1200, unix.CmsgSpace(2)},
+		{"IPv4 source", Mmsg{Addr: v4, Src: netip.MustParseAddr("192.0.2.9")}, 0, unix.CmsgSpace(unix.SizeofInet4Pktinfo)},
+		{"IPv4 interface", Mmsg{Addr: v4, IfIndex: 2}, 0, unix.CmsgSpace(unix.SizeofInet4Pktinfo)},
+		{"IPv6 source", Mmsg{Addr: v6, Src: netip.MustParseAddr("2001:db8::9"), IfIndex: 2}, 0, unix.CmsgSpace(unix.SizeofInet6Pktinfo)},
+		{"IPv4-mapped source", Mmsg{Addr: mapped, Src: netip.MustParseAddr("::ffff:192.0.2.9")}, 0, unix.CmsgSpace(unix.SizeofInet4Pktinfo)},
+		{"IPv4 TOS and TTL", Mmsg{Addr: v4, TOS: 0xb8, TTL: 9}, 0, 2 * unix.CmsgSpace(4)},
+		{"IPv6 TOS and TTL", Mmsg{Addr: v6, TOS: 0xb8, TTL: 9}, 0, 2 * unix.CmsgSpace(4)},
+		{"all", Mmsg{Addr: v6, Src: netip.MustParseAddr("2001:db8::9"), IfIndex: 2, TOS: 1, TTL: 2}, 1000, sendControlSpace},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := make([]byte, sendControlSpace)
+			l := putControl(b, &tt.msg, tt.segment)
+			if l != tt.space {
+				t.Fatalf("putControl() = %d, want %d", l, tt.space)
+			}
+
+			b = b[:l]
+			is4 := tt.msg.Addr.Addr().Unmap().Is4()
+			if data := findCmsg(t, b, unix.IPPROTO_UDP, udpSegment); tt.segment > 0 && (len(data) < 2 || int(*(*uint16)(unsafe.Pointer(&data[0]))) != tt.segment) {
+				t.Fatalf("UDP_SEGMENT = %v, want %d", data, tt.segment)
+			}
+
+			// the TOS and the TTL are sent the way they are received
+			var cm ControlMessage
+			(&ReaderWriter{}).parseControl(b, &cm)
+			if cm.TOS != tt.msg.TOS || cm.TTL != tt.msg.TTL {
+				t.Fatalf("TOS %d and TTL %d decoded, want %d and %d", cm.TOS, cm.TTL, tt.msg.TOS, tt.msg.TTL)
+			}
+
+			if !tt.msg.Src.IsValid() && tt.msg.IfIndex == 0 {
+				return
+			}
+
+			if cm.IfIndex != tt.msg.IfIndex {
+				t.Fatalf("interface %d decoded, want %d", cm.IfIndex, tt.msg.IfIndex)
+			}
+
+			// IP_PKTINFO carries the source in ipi_spec_dst, IPV6_PKTINFO in ipi6_addr
+			var src netip.Addr
+			if is4 {
+				info := (*unix.Inet4Pktinfo)(unsafe.Pointer(&findCmsg(t, b, unix.IPPROTO_IP, unix.IP_PKTINFO)[0]))
+				src = netip.AddrFrom4(info.Spec_dst)
+			} else {
+				src = cm.Dst
+			}
+
+			want := tt.msg.Src.Unmap()
+			if !tt.msg.Src.IsValid() {
+				want = netip.AddrFrom4([4]byte{})
+			}
+			if src != want {
+				t.Fatalf("source %v, want %v", src, want)
+			}
+		})
+	}
+}
+
+func TestDropsWraparound(t *testing.T) {
+	tests := []struct {
+		name   string
+		counts []uint32 // the SO_RXQ_OVFL of the datagrams in reading order
+		want   uint32
+	}{
+		{"growing", []uint32{1, 5, 9}, 9},
+		{"reordered in a batch", []uint32{5, 3, 4}, 5},
+		{"wraps around", []uint32{0xfffffff0, 0xffffffff, 3}, 3},
+		{"reordered across the wrap", []uint32{2, 0xfffffffe, 1}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := &ReaderWriter{}
+			var cm ControlMessage
+			for _, count := range tt.counts {
+				rw.parseControl(*new(cmsgBuilder).addInt(unix.SOL_SOCKET, unix.SO_RXQ_OVFL, int32(count)), &cm)
+				if cm.Drops != count {
+					t.Fatalf("ControlMessage.Drops = %d, want %d", cm.Drops, count)
+				}
+			}
+
+			if rw.Drops() != tt.want {
+				t.Fatalf("Drops() = %#x, want %#x", rw.Drops(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDropsLoopback(t *testing.T) {
+	rw, addr := newTestRW(t, "udp4", "127.0.0.1:0", SocketOptions{RecvDrops: true, ReadBuffer: 4096})
+	if rw.controlSpace == 0 {
+		t.Skip("SO_RXQ_OVFL isn't supported")
+	}
+
+	conn := listenTest(t, "udp4")
+	data := make([]byte, 1000)
+	for i := 0; i < 256; i++ {
+		conn.WriteToUDPAddrPort(data, addr)
+	}
+
+	if got := readRW(t, rw, 256); len(got) == 256 {
+		t.Skip("the receive queue didn't overflow")
+	}
+
+	// the count comes with the datagrams queued after the drops
+	conn.WriteToUDPAddrPort(data, addr)
+	if got := readRW(t, rw, 1); len(got) != 1 {
+		t.Fatalf("received %d datagrams, want 1", len(got))
+	}
+
+	if rw.Drops() == 0 {
+		t.Fatal("Drops() = 0 after the receive queue overflowed")
+	}
+}
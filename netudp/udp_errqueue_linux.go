@@ -0,0 +1,116 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import (
+	"net/netip"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const sizeofSockExtendedErr = int(unsafe.Sizeof(unix.SockExtendedErr{}))
+
+// ReadErrQueue drains the error queue of the socket, which SocketOptions.RecvErr
+// fills, and calls errFunc for every error, e is safe to retain. It returns the
+// number of errors read. The completions of zero-copy sends, which are queued
+// there too, call the Done of their datagrams.
+func (rw *ReaderWriter) ReadErrQueue(errFunc func(e *PeerError)) (int, error) {
+	var name unix.RawSockaddrInet6
+	var control [512]byte
+	// the payload is the datagram which caused the error, it isn't needed
+	var data [1]byte
+	iov := iovec{Base: &data[0], Len: uint64(len(data))}
+
+	n := 0
+	for {
+		hdr := msghdr{Iov: &iov, Iovlen: 1}
+		hdr.Name = (*byte)(unsafe.Pointer(&name))
+		hdr.Namelen = unix.SizeofSockaddrInet6
+		hdr.Control = &control[0]
+		hdr.Controllen = uint64(len(control))
+		_, _, errno := unix.Syscall(unix.SYS_RECVMSG, uintptr(rw.fd), uintptr(unsafe.Pointer(&hdr)), unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+		if errno != 0 {
+			if errno == unix.EAGAIN || errno == unix.EWOULDBLOCK {
+				return n, nil
+			}
+
+			return n, os.NewSyscallError("recvmsg", errno)
+		}
+
+		ee, off := extendedErr(control[:hdr.Controllen])
+		if ee == nil {
+			continue
+		}
+
+		if ee.Origin == unix.SO_EE_ORIGIN_ZEROCOPY {
+			// the range of zero-copy sends which completed, it's reported
+			// whether the kernel had to copy the data or not
+			if rw.zc != nil {
+				rw.zc.complete(ee.Info, ee.Data)
+			}
+			continue
+		}
+
+		e := &PeerError{
+			Err:      syscall.Errno(ee.Errno),
+			Offender: offender(off),
+			Origin:   int(ee.Origin),
+			Type:     int(ee.Type),
+			Code:     int(ee.Code),
+			Info:     ee.Info,
+		}
+		e.Addr, _ = rw.sockaddrAddrPort(unsafe.Pointer(&name))
+		n++
+		errFunc(e)
+	}
+}
+
+// extendedErr returns the sock_extended_err of the IP_RECVERR or IPV6_RECVERR
+// cmsg of b and the bytes following it, nil when there is none.
+func extendedErr(b []byte) (*unix.SockExtendedErr, []byte) {
+	for len(b) >= unix.SizeofCmsghdr {
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+		if h.Len < unix.SizeofCmsghdr || int(h.Len) > len(b) {
+			return nil, nil
+		}
+
+		data := b[unix.CmsgLen(0):h.Len]
+		if (h.Level == unix.IPPROTO_IP && h.Type == unix.IP_RECVERR ||
+			h.Level == unix.IPPROTO_IPV6 && h.Type == unix.IPV6_RECVERR) &&
+			len(data) >= sizeofSockExtendedErr {
+			return (*unix.SockExtendedErr)(unsafe.Pointer(&data[0])), data[sizeofSockExtendedErr:]
+		}
+
+		space := unix.CmsgSpace(int(h.Len) - unix.CmsgLen(0))
+		if space >= len(b) {
+			return nil, nil
+		}
+		b = b[space:]
+	}
+
+	return nil, nil
+}
+
+// offender decodes SO_EE_OFFENDER, the sockaddr following sock_extended_err.
+func offender(b []byte) netip.Addr {
+	if len(b) < unix.SizeofSockaddrInet4 {
+		return netip.Addr{}
+	}
+
+	switch (*sockaddrFamily)(unsafe.Pointer(&b[0])).Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(&b[0]))
+		return netip.AddrFrom4(sa.Addr)
+	case unix.AF_INET6:
+		if len(b) >= unix.SizeofSockaddrInet6 {
+			sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(&b[0]))
+			return netip.AddrFrom16(sa.Addr).Unmap()
+		}
+	}
+
+	return netip.Addr{}
+}
@@ -0,0 +1,140 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func sockaddr4(addr netip.Addr) []byte {
+	sa := unix.RawSockaddrInet4{Family: unix.AF_INET, Addr: addr.As4()}
+	return (*[unix.SizeofSockaddrInet4]byte)(unsafe.Pointer(&sa))[:]
+}
+
+func sockaddr6(addr netip.Addr) []byte {
+	sa := unix.RawSockaddrInet6{Family: unix.AF_INET6, Addr: addr.As16()}
+	return (*[unix.SizeofSockaddrInet6]byte)(unsafe.Pointer(&sa))[:]
+}
+
+// recvErr returns a sock_extended_err followed by the sockaddr of offender.
+func recvErr(ee unix.SockExtendedErr, offender []byte) []byte {
+	b := append([]byte(nil), (*[sizeofSockExtendedErr]byte)(unsafe.Pointer(&ee))[:]...)
+	return append(b, offender...)
+}
+
+func TestExtendedErr(t *testing.T) {
+	ee := unix.SockExtendedErr{Errno: uint32(unix.ECONNREFUSED), Origin: unix.SO_EE_ORIGIN_ICMP, Type: 3, Code: 3}
+	router := netip.MustParseAddr("192.0.2.1")
+	tests := []struct {
+		name     string
+		b        *cmsgBuilder
+		found    bool
+		offender netip.Addr
+	}{
+		{"none", &cmsgBuilder{}, false, netip.Addr{}},
+		{"IP_RECVERR", new(cmsgBuilder).add(unix.IPPROTO_IP, unix.IP_RECVERR, recvErr(ee, sockaddr4(router))), true, router},
+		{"IPV6_RECVERR", new(cmsgBuilder).add(unix.IPPROTO_IPV6, unix.IPV6_RECVERR, recvErr(ee, sockaddr6(netip.MustParseAddr("2001:db8::1")))),
+			true, netip.MustParseAddr("2001:db8::1")},
+		{"after another cmsg", new(cmsgBuilder).addInt(unix.IPPROTO_IP, unix.IP_TTL, 1).add(unix.IPPROTO_IP, unix.IP_RECVERR, recvErr(ee, sockaddr4(router))),
+			true, router},
+		{"without offender", new(cmsgBuilder).add(unix.IPPROTO_IP, unix.IP_RECVERR, recvErr(ee, nil)), true, netip.Addr{}},
+		{"too short", new(cmsgBuilder).add(unix.IPPROTO_IP, unix.IP_RECVERR, recvErr(ee, nil)[:sizeofSockExtendedErr-1]), false, netip.Addr{}},
+		{"other level", new(cmsgBuilder).add(unix.SOL_SOCKET, unix.IP_RECVERR, recvErr(ee, nil)), false, netip.Addr{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, off := extendedErr(*tt.b)
+			if (got != nil) != tt.found {
+				t.Fatalf("extendedErr() found %v, want %v", got != nil, tt.found)
+			}
+
+			if got == nil {
+				return
+			}
+
+			if *got != ee {
+				t.Fatalf("extendedErr() = %+v, want %+v", *got, ee)
+			}
+
+			if addr := offender(off); addr != tt.offender {
+				t.Fatalf("offender() = %v, want %v", addr, tt.offender)
+			}
+		})
+	}
+}
+
+func TestOffender(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want netip.Addr
+	}{
+		{"empty", nil, netip.Addr{}},
+		{"IPv4", sockaddr4(netip.MustParseAddr("192.0.2.1")), netip.MustParseAddr("192.0.2.1")},
+		{"IPv6", sockaddr6(netip.MustParseAddr("2001:db8::1")), netip.MustParseAddr("2001:db8::1")},
+		{"IPv4-mapped", sockaddr6(netip.MustParseAddr("::ffff:192.0.2.1")), netip.MustParseAddr("192.0.2.1")},
+		{"truncated IPv6", sockaddr6(netip.MustParseAddr("2001:db8::1"))[:unix.SizeofSockaddrInet4], netip.Addr{}},
+		// SO_EE_ORIGIN_LOCAL errors carry AF_UNSPEC
+		{"unspecified", make([]byte, unix.SizeofSockaddrInet6), netip.Addr{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if addr := offender(tt.b); addr != tt.want {
+				t.Fatalf("offender() = %v, want %v", addr, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadErrQueueLoopback(t *testing.T) {
+	for _, network := range []string{"udp4", "udp6"} {
+		t.Run(network, func(t *testing.T) {
+			loopback := "127.0.0.1:0"
+			if network == "udp6" {
+				loopback = "[::1]:0"
+			}
+
+			rw, _ := newTestRW(t, network, loopback, SocketOptions{RecvErr: true})
+			// a port nobody listens on once conn is closed
+			conn := listenTest(t, network)
+			closed := AddrPortOf(conn.LocalAddr().(*net.UDPAddr))
+			conn.Close()
+
+			if err := rw.WriteToAddrPort([]byte("ping"), closed); err != nil && !errors.Is(err, unix.ECONNREFUSED) {
+				t.Fatalf("WriteToAddrPort: %v", err)
+			}
+
+			fds := []unix.PollFd{{Fd: int32(rw.fd), Events: unix.POLLIN}}
+			if n, _ := unix.Poll(fds, 2000); n == 0 || fds[0].Revents&unix.POLLERR == 0 {
+				t.Skip("no ICMP error was queued")
+			}
+
+			var errs []*PeerError
+			if _, err := rw.ReadErrQueue(func(e *PeerError) { errs = append(errs, e) }); err != nil {
+				t.Fatalf("ReadErrQueue: %v", err)
+			}
+
+			if len(errs) != 1 {
+				t.Fatalf("read %d errors, want 1", len(errs))
+			}
+
+			e := errs[0]
+			if !errors.Is(e, unix.ECONNREFUSED) || e.Addr != closed || !e.Offender.IsLoopback() {
+				t.Fatalf("error %v to %v from %v, want ECONNREFUSED to %v from the loopback", e.Err, e.Addr, e.Offender, closed)
+			}
+
+			if e.Origin != unix.SO_EE_ORIGIN_ICMP && e.Origin != unix.SO_EE_ORIGIN_ICMP6 {
+				t.Fatalf("origin %d, want ICMP", e.Origin)
+			}
+		})
+	}
+}
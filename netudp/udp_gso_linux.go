@@ -0,0 +1,103 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import (
+	"errors"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// UDP_SEGMENT from include/uapi/linux/udp.h, it's missing in x/sys,
+	// its level SOL_UDP equals IPPROTO_UDP.
+	udpSegment = 103
+	// UDP_GRO from include/uapi/linux/udp.h.
+	udpGRO = 104
+	// groBufferSize holds the largest buffer GRO coalesces.
+	groBufferSize = 65535
+	// gsoMaxSegments is UDP_MAX_SEGMENTS of the kernels which introduced UDP_SEGMENT.
+	gsoMaxSegments = 64
+	// gsoMaxBytes keeps a coalesced datagram below the IPv4 and IPv6 size limits.
+	gsoMaxBytes = 65000
+)
+
+// EnableGSO makes WriteToN coalesce consecutive datagrams to the same address
+// into one UDP_SEGMENT send, it reports whether the kernel supports it.
+func (rw *ReaderWriter) EnableGSO() bool {
+	if _, err := unix.GetsockoptInt(rw.fd, unix.IPPROTO_UDP, udpSegment); err != nil {
+		return false
+	}
+
+	atomic.StoreInt32(&rw.gso, 1)
+	return true
+}
+
+// GSO reports whether WriteToN coalesces datagrams, it turns false when the
+// kernel or the device rejects segmentation.
+func (rw *ReaderWriter) GSO() bool {
+	return atomic.LoadInt32(&rw.gso) == 1
+}
+
+// gsoRun returns how many datagrams from the head of mmsgs can be sent as one
+// segmented datagram: they have the same addresses and the same size, only the
+// last one may be shorter.
+func gsoRun(mmsgs []*Mmsg) int {
+	first := mmsgs[0]
+	size := len(first.Data)
+	total := size
+	n := 1
+	for n < len(mmsgs) && n < gsoMaxSegments {
+		msg := mmsgs[n]
+		if msg.Addr != first.Addr || msg.Src != first.Src || msg.IfIndex != first.IfIndex || msg.TOS != first.TOS || msg.TTL != first.TTL ||
+			len(msg.Data) > size || total+len(msg.Data) > gsoMaxBytes {
+			break
+		}
+
+		total += len(msg.Data)
+		n++
+		if len(msg.Data) < size {
+			break
+		}
+	}
+
+	return n
+}
+
+// putSegmentSize stores a UDP_SEGMENT cmsg into b, which is CmsgSpace(2) long.
+func putSegmentSize(b []byte, size int) {
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = unix.IPPROTO_UDP
+	h.Type = udpSegment
+	h.SetLen(unix.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&b[unix.CmsgLen(0)])) = uint16(size)
+}
+
+// isGSOUnsupported reports whether err means that segmentation is not available
+// on the socket at all, e.g. the device has no checksum offload.
+func isGSOUnsupported(err error) bool {
+	return errors.Is(err, unix.EIO) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOPROTOOPT)
+}
+
+// EnableGRO asks the kernel to coalesce datagrams of a flow into one buffer,
+// they are split back before being delivered. Every read slot grows to hold
+// a coalesced buffer. It must be called before the first read and reports
+// whether the kernel supports it.
+func (rw *ReaderWriter) EnableGRO() bool {
+	if err := unix.SetsockoptInt(rw.fd, unix.IPPROTO_UDP, udpGRO, 1); err != nil {
+		return false
+	}
+
+	for i := range rw.buffers {
+		rw.buffers[i] = make([]byte, groBufferSize)
+		rw.iovs[i].Base = (*byte)(unsafe.Pointer(&rw.buffers[i][0]))
+		rw.iovs[i].Len = uint64(len(rw.buffers[i]))
+	}
+
+	rw.addControl(unix.CmsgSpace(4))
+	rw.gro = true
+	return true
+}
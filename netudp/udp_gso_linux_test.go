@@ -0,0 +1,163 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// newTestRW returns a ReaderWriter of a socket bound to a loopback port picked
+// by the kernel, the socket is closed at the end of the test.
+func newTestRW(t *testing.T, network, addr string, opts SocketOptions) (*ReaderWriter, netip.AddrPort) {
+	t.Helper()
+	fd, sa, err := NewUDPSocket(network, addr, opts)
+	if err != nil {
+		t.Fatalf("NewUDPSocket: %v", err)
+	}
+
+	t.Cleanup(func() { unix.Close(fd) })
+	if sa, err = unix.Getsockname(fd); err != nil {
+		t.Fatalf("getsockname: %v", err)
+	}
+
+	return NewRW(fd, 16, 1500), SockaddrToAddrPort(sa)
+}
+
+// listenTest returns a net.UDPConn bound to a loopback port picked by the kernel.
+func listenTest(t *testing.T, network string) *net.UDPConn {
+	t.Helper()
+	ip := net.IPv4(127, 0, 0, 1)
+	if network == "udp6" {
+		ip = net.IPv6loopback
+	}
+
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Skipf("listen %v: %v", network, err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readTest reads datagrams from conn until n arrived or none came for a while.
+func readTest(t *testing.T, conn *net.UDPConn, n int) [][]byte {
+	t.Helper()
+	var datagrams [][]byte
+	buf := make([]byte, 65536)
+	for len(datagrams) < n {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		m, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		datagrams = append(datagrams, append([]byte(nil), buf[:m]...))
+	}
+
+	return datagrams
+}
+
+func testMmsgs(addr netip.AddrPort, sizes ...int) []*Mmsg {
+	mmsgs := make([]*Mmsg, len(sizes))
+	for i, size := range sizes {
+		mmsgs[i] = &Mmsg{Addr: addr, Data: bytes.Repeat([]byte{byte(i)}, size)}
+	}
+	return mmsgs
+}
+
+func TestGSORun(t *testing.T) {
+	a := netip.MustParseAddrPort("10.0.0.1:53")
+	b := netip.MustParseAddrPort("10.0.0.2:53")
+	sizes := func(n, size int) []int {
+		s := make([]int, n)
+		for i := range s {
+			s[i] = size
+		}
+		return s
+	}
+
+	tests := []struct {
+		name  string
+		mmsgs []*Mmsg
+		want  int
+	}{
+		{"one", testMmsgs(a, 100), 1},
+		{"same size", testMmsgs(a, 100, 100, 100), 3},
+		{"shorter last", testMmsgs(a, 100, 100, 50), 3},
+		{"shorter ends the run", testMmsgs(a, 100, 50, 50), 2},
+		{"larger ends the run", testMmsgs(a, 100, 100, 200), 2},
+		{"max segments", testMmsgs(a, sizes(gsoMaxSegments+10, 10)...), gsoMaxSegments},
+		{"max bytes", testMmsgs(a, sizes(10, 10000)...), gsoMaxBytes / 10000},
+		{"address", append(testMmsgs(a, 100, 100), testMmsgs(b, 100)...), 2},
+		{"source", append(testMmsgs(a, 100), &Mmsg{Addr: a, Data: make([]byte, 100), Src: netip.MustParseAddr("127.0.0.2")}), 1},
+		{"interface", append(testMmsgs(a, 100), &Mmsg{Addr: a, Data: make([]byte, 100), IfIndex: 1}), 1},
+		{"TOS", append(testMmsgs(a, 100), &Mmsg{Addr: a, Data: make([]byte, 100), TOS: 4}), 1},
+		{"TTL", append(testMmsgs(a, 100), &Mmsg{Addr: a, Data: make([]byte, 100), TTL: 1}), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if n := gsoRun(tt.mmsgs); n != tt.want {
+				t.Fatalf("gsoRun() = %d, want %d", n, tt.want)
+			}
+		})
+	}
+}
+
+func TestPutSegmentSize(t *testing.T) {
+	b := make([]byte, unix.CmsgSpace(2))
+	putSegmentSize(b, 1200)
+	cmsgs, err := unix.ParseSocketControlMessage(b)
+	if err != nil || len(cmsgs) != 1 {
+		t.Fatalf("ParseSocketControlMessage() = %v, %v", cmsgs, err)
+	}
+
+	h := cmsgs[0].Header
+	if h.Level != unix.IPPROTO_UDP || h.Type != udpSegment || len(cmsgs[0].Data) < 2 {
+		t.Fatalf("cmsg %+v, want UDP_SEGMENT", h)
+	}
+
+	if size := int(cmsgs[0].Data[0]) | int(cmsgs[0].Data[1])<<8; size != 1200 {
+		t.Fatalf("segment size %d, want 1200", size)
+	}
+}
+
+func TestGSOLoopback(t *testing.T) {
+	rw, _ := newTestRW(t, "udp4", "127.0.0.1:0", SocketOptions{})
+	if !rw.EnableGSO() {
+		t.Skip("UDP_SEGMENT isn't supported")
+	}
+
+	conn := listenTest(t, "udp4")
+	peer := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	mmsgs := testMmsgs(peer, 300, 300, 300, 300, 100)
+	mmsgs = append(mmsgs, testMmsgs(peer, 500)...)
+
+	n, err := rw.WriteToN(mmsgs...)
+	if err != nil || n != len(mmsgs) {
+		t.Fatalf("WriteToN() = %d, %v, want %d", n, err, len(mmsgs))
+	}
+
+	if !rw.GSO() {
+		t.Skip("the loopback device rejected segmentation")
+	}
+
+	// the kernel splits the segmented datagram back into the datagrams of the run
+	datagrams := readTest(t, conn, len(mmsgs))
+	if len(datagrams) != len(mmsgs) {
+		t.Fatalf("received %d datagrams, want %d", len(datagrams), len(mmsgs))
+	}
+
+	for i, d := range datagrams {
+		if !bytes.Equal(d, mmsgs[i].Data) {
+			t.Fatalf("datagram %d has %d bytes of %d, want %d bytes of %d", i, len(d), d[0], len(mmsgs[i].Data), i)
+		}
+	}
+}
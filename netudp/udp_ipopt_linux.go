@@ -0,0 +1,115 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import (
+	"net/netip"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ipOption is an option which exists at the IPv4 and at the IPv6 level.
+type ipOption struct {
+	v4, v6 int
+}
+
+var (
+	optTOS     = ipOption{unix.IP_TOS, unix.IPV6_TCLASS}
+	optRecvTOS = ipOption{unix.IP_RECVTOS, unix.IPV6_RECVTCLASS}
+	optTTL     = ipOption{unix.IP_TTL, unix.IPV6_UNICAST_HOPS}
+	optRecvTTL = ipOption{unix.IP_RECVTTL, unix.IPV6_RECVHOPLIMIT}
+	optRecvErr = ipOption{unix.IP_RECVERR, unix.IPV6_RECVERR}
+	// cmsgTTL is the type of the cmsgs carrying a TTL, the option is optTTL on send
+	cmsgTTL = ipOption{unix.IP_TTL, unix.IPV6_HOPLIMIT}
+)
+
+// applyIPOptions sets the IP level options of opts on fd.
+func applyIPOptions(fd int, opts SocketOptions) error {
+	if opts.TOS == 0 && !opts.RecvTOS && opts.TTL == 0 && !opts.RecvTTL && !opts.RecvErr &&
+		opts.PMTUDiscovery == PMTUDiscoveryDefault {
+		return nil
+	}
+
+	domain, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+	if err != nil {
+		return os.NewSyscallError("getsockopt", err)
+	}
+
+	options := []struct {
+		opt   ipOption
+		value int
+	}{
+		{optTOS, opts.TOS},
+		{optRecvTOS, boolint(opts.RecvTOS)},
+		{optTTL, opts.TTL},
+		{optRecvTTL, boolint(opts.RecvTTL)},
+		{optRecvErr, boolint(opts.RecvErr)},
+	}
+
+	for _, o := range options {
+		if o.value == 0 {
+			continue
+		}
+
+		if err := setIPOption(fd, domain, o.opt, o.value); err != nil {
+			return err
+		}
+	}
+
+	return applyPMTUDiscovery(fd, domain, opts.PMTUDiscovery)
+}
+
+// setIPOption sets opt on fd. An IPv6 socket also gets the IPv4 option for the
+// IPv4 datagrams of a dual-stack socket, it fails on an IPv6-only socket which
+// is fine.
+func setIPOption(fd, domain int, opt ipOption, value int) error {
+	if domain == unix.AF_INET6 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, opt.v6, value); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, opt.v4, value); err != nil && domain == unix.AF_INET {
+		return os.NewSyscallError("setsockopt", err)
+	}
+
+	return nil
+}
+
+// ipOptionEnabled reports whether opt is set at either level of fd.
+func ipOptionEnabled(fd int, opt ipOption) bool {
+	if on, err := unix.GetsockoptInt(fd, unix.IPPROTO_IP, opt.v4); err == nil && on != 0 {
+		return true
+	}
+
+	on, err := unix.GetsockoptInt(fd, unix.IPPROTO_IPV6, opt.v6)
+	return err == nil && on != 0
+}
+
+// putIPCmsg stores the int cmsg of type typ for a datagram to addr into b and
+// returns its space, 0 when value is 0.
+func putIPCmsg(b []byte, addr netip.AddrPort, typ ipOption, value int) int {
+	if value == 0 {
+		return 0
+	}
+
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level, h.Type = unix.IPPROTO_IPV6, int32(typ.v6)
+	if addr.Addr().Unmap().Is4() {
+		h.Level, h.Type = unix.IPPROTO_IP, int32(typ.v4)
+	}
+	h.SetLen(unix.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&b[unix.CmsgLen(0)])) = int32(value)
+	return unix.CmsgSpace(4)
+}
+
+func boolint(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
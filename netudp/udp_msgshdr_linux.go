@@ -1,3 +1,4 @@
+//go:build linux
 // +build linux
 
 package netudp
@@ -42,8 +43,9 @@ const (
 	sizeofSockaddrInet6 = 0x1c // IPv6
 )
 
-func prepare(n, mtu int) ([]mmsghdr, [][]byte, [][]byte) {
+func prepare(n, mtu int) ([]mmsghdr, []iovec, [][]byte, [][]byte) {
 	mms := make([]mmsghdr, n)
+	iovs := make([]iovec, n)
 	buffers := make([][]byte, n)
 	names := make([][]byte, n)
 
@@ -51,12 +53,11 @@ func prepare(n, mtu int) ([]mmsghdr, [][]byte, [][]byte) {
 		buffers[i] = make([]byte, mtu)
 		names[i] = make([]byte, sizeofSockaddrInet6)
 
-		v := []iovec{
-			{Base: (*byte)(unsafe.Pointer(&buffers[i][0])), Len: uint64(len(buffers[i]))},
-		}
+		iovs[i].Base = (*byte)(unsafe.Pointer(&buffers[i][0]))
+		iovs[i].Len = uint64(len(buffers[i]))
 
-		mms[i].Hdr.Iov = &v[0]
-		mms[i].Hdr.Iovlen = uint64(len(v))
+		mms[i].Hdr.Iov = &iovs[i]
+		mms[i].Hdr.Iovlen = 1
 
 		mms[i].Hdr.Name = (*byte)(unsafe.Pointer(&names[i][0]))
 		mms[i].Hdr.Namelen = uint32(len(names[i]))
@@ -64,5 +65,5 @@ func prepare(n, mtu int) ([]mmsghdr, [][]byte, [][]byte) {
 		// ignore mms[i].Hdr.Control and mms[i].Hdr.Controllen
 	}
 
-	return mms, buffers, names
+	return mms, iovs, buffers, names
 }
@@ -0,0 +1,81 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import (
+	"fmt"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// EnablePktInfo makes every read report the local address and the interface of
+// the datagram in ControlMessage, it reports whether the socket supports it.
+// It must be called before the first read.
+func (rw *ReaderWriter) EnablePktInfo() bool {
+	domain, err := unix.GetsockoptInt(rw.fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+	if err != nil {
+		return false
+	}
+
+	// IPV6_RECVPKTINFO also covers the IPv4 datagrams of a dual-stack socket
+	if domain == unix.AF_INET6 {
+		if err := unix.SetsockoptInt(rw.fd, unix.IPPROTO_IPV6, unix.IPV6_RECVPKTINFO, 1); err != nil {
+			return false
+		}
+
+		rw.addControl(unix.CmsgSpace(unix.SizeofInet6Pktinfo))
+		return true
+	}
+
+	if err := unix.SetsockoptInt(rw.fd, unix.IPPROTO_IP, unix.IP_PKTINFO, 1); err != nil {
+		return false
+	}
+
+	rw.addControl(unix.CmsgSpace(unix.SizeofInet4Pktinfo))
+	return true
+}
+
+// WriteMsgTo is WriteToAddrPort sending from the local address src through the
+// interface ifIndex, a zero src or ifIndex lets the kernel pick it.
+func (rw *ReaderWriter) WriteMsgTo(data []byte, addr netip.AddrPort, src netip.Addr, ifIndex int) error {
+	if !addr.IsValid() {
+		return fmt.Errorf("writemsgto: data or addr invalid")
+	}
+
+	return rw.WriteMsg(&Mmsg{Addr: addr, Data: data, Src: src, IfIndex: ifIndex})
+}
+
+// putPktinfo stores the pktinfo cmsg selecting src and ifIndex for a datagram
+// to addr into b and returns its space, 0 when neither is set.
+func putPktinfo(b []byte, addr netip.AddrPort, src netip.Addr, ifIndex int) int {
+	if !src.IsValid() && ifIndex == 0 {
+		return 0
+	}
+
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	data := unsafe.Pointer(&b[unix.CmsgLen(0)])
+	if addr.Addr().Unmap().Is4() {
+		h.Level = unix.IPPROTO_IP
+		h.Type = unix.IP_PKTINFO
+		h.SetLen(unix.CmsgLen(unix.SizeofInet4Pktinfo))
+		info := (*unix.Inet4Pktinfo)(data)
+		*info = unix.Inet4Pktinfo{Ifindex: int32(ifIndex)}
+		if src.IsValid() {
+			info.Spec_dst = src.Unmap().As4()
+		}
+		return unix.CmsgSpace(unix.SizeofInet4Pktinfo)
+	}
+
+	h.Level = unix.IPPROTO_IPV6
+	h.Type = unix.IPV6_PKTINFO
+	h.SetLen(unix.CmsgLen(unix.SizeofInet6Pktinfo))
+	info := (*unix.Inet6Pktinfo)(data)
+	*info = unix.Inet6Pktinfo{Ifindex: uint32(ifIndex)}
+	if src.IsValid() {
+		info.Addr = src.As16()
+	}
+	return unix.CmsgSpace(unix.SizeofInet6Pktinfo)
+}
@@ -0,0 +1,129 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var optMTUDiscover = ipOption{unix.IP_MTU_DISCOVER, unix.IPV6_MTU_DISCOVER}
+
+// pmtuDiscoveryValue returns the IP_PMTUDISC_* of mode, the IPV6_PMTUDISC_*
+// constants have the same values.
+func pmtuDiscoveryValue(mode PMTUDiscovery) (int, error) {
+	switch mode {
+	case PMTUDiscoveryDont:
+		return unix.IP_PMTUDISC_DONT, nil
+	case PMTUDiscoveryWant:
+		return unix.IP_PMTUDISC_WANT, nil
+	case PMTUDiscoveryDo:
+		return unix.IP_PMTUDISC_DO, nil
+	case PMTUDiscoveryProbe:
+		return unix.IP_PMTUDISC_PROBE, nil
+	}
+
+	return 0, fmt.Errorf("unknown path MTU discovery mode: %d", mode)
+}
+
+// pmtuDiscoveryOf is the inverse of pmtuDiscoveryValue, modes PMTUDiscovery
+// can't express, e.g. IP_PMTUDISC_INTERFACE, map to PMTUDiscoveryDefault.
+func pmtuDiscoveryOf(v int) PMTUDiscovery {
+	switch v {
+	case unix.IP_PMTUDISC_DONT:
+		return PMTUDiscoveryDont
+	case unix.IP_PMTUDISC_WANT:
+		return PMTUDiscoveryWant
+	case unix.IP_PMTUDISC_DO:
+		return PMTUDiscoveryDo
+	case unix.IP_PMTUDISC_PROBE:
+		return PMTUDiscoveryProbe
+	default:
+		return PMTUDiscoveryDefault
+	}
+}
+
+// applyPMTUDiscovery sets IP_MTU_DISCOVER and IPV6_MTU_DISCOVER on fd.
+func applyPMTUDiscovery(fd, domain int, mode PMTUDiscovery) error {
+	if mode == PMTUDiscoveryDefault {
+		return nil
+	}
+
+	value, err := pmtuDiscoveryValue(mode)
+	if err != nil {
+		return err
+	}
+
+	return setIPOption(fd, domain, optMTUDiscover, value)
+}
+
+// tooLong returns the error of a datagram to addr longer than the MTU rw was
+// created with, the caller re-segments as for a path MTU exceeded.
+func (rw *ReaderWriter) tooLong(addr netip.AddrPort) error {
+	return &PeerError{Addr: addr, Err: unix.EMSGSIZE, Origin: unix.SO_EE_ORIGIN_LOCAL}
+}
+
+// PathMTU returns the MTU the kernel knows for the path to addr: the MTU of the
+// outgoing interface until an ICMP fragmentation needed or packet too big lowers
+// it. It's read from a temporary socket connected to addr, no datagram is sent.
+// opts are applied to the socket, the Mark, BindToDevice and Control of the
+// socket the datagrams leave from select the same route.
+func PathMTU(addr netip.AddrPort, opts SocketOptions) (int, error) {
+	if !addr.IsValid() {
+		return 0, fmt.Errorf("pathmtu: addr invalid")
+	}
+
+	family, sa, err := sockaddrOf(addr)
+	if err != nil {
+		return 0, err
+	}
+
+	fd, err := newSocket(family)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+
+	network := "udp4"
+	if family == unix.AF_INET6 {
+		network = "udp6"
+	}
+
+	if err := applySocketOptions(fd, network, addr.String(), opts); err != nil {
+		return 0, err
+	}
+
+	if err := unix.Connect(fd, sa); err != nil {
+		return 0, os.NewSyscallError("connect", err)
+	}
+
+	return socketPathMTU(fd, family)
+}
+
+// PathMTU returns the MTU of the path to the peer of a connected socket.
+func (rw *ReaderWriter) PathMTU() (int, error) {
+	domain, err := unix.GetsockoptInt(rw.fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+	if err != nil {
+		return 0, os.NewSyscallError("getsockopt", err)
+	}
+
+	return socketPathMTU(rw.fd, domain)
+}
+
+func socketPathMTU(fd, domain int) (int, error) {
+	level, opt := unix.IPPROTO_IP, unix.IP_MTU
+	if domain == unix.AF_INET6 {
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_MTU
+	}
+
+	mtu, err := unix.GetsockoptInt(fd, level, opt)
+	if err != nil {
+		return 0, os.NewSyscallError("getsockopt", err)
+	}
+
+	return mtu, nil
+}
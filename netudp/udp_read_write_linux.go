@@ -4,81 +4,250 @@
 package netudp
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
-	"reflect"
+	"sync/atomic"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
-var zero [32]byte
-
 type Mmsg struct {
-	Addr *net.UDPAddr
+	Addr netip.AddrPort
 	Data []byte
+	// Src and IfIndex select the local address and the interface, see WriteMsgTo.
+	Src     netip.Addr
+	IfIndex int
+	// TOS and TTL override SocketOptions.TOS and SocketOptions.TTL for the
+	// datagram when they aren't 0.
+	TOS int
+	TTL int
+	// Done is called once Data can be reused after the datagram was sent, right
+	// away unless zero-copy is enabled, see EnableZeroCopy. It isn't called when
+	// the datagram isn't sent.
+	Done func()
 }
 
 type ReaderWriter struct {
 	fd         int
 	msgs       []mmsghdr
+	iovs       []iovec
 	buffers    [][]byte
+	cur        []byte // datagram being delivered
+	slot       int    // index of the read buffer holding cur
 	names      [][]byte
+	controls   [][]byte
+	cm         ControlMessage
 	remoteAddr *net.UDPAddr
+	remoteIP   [16]byte
 	dc         [32]byte
 	mtu        int
-	sockaddr4  unix.RawSockaddrInet4
-	sockaddr6  unix.RawSockaddrInet6
+	gso        int32 // 1 when WriteToN coalesces datagrams
+	gro        bool
+	drops      uint32 // latest ControlMessage.Drops
+	zc         *zeroCopy
+	ring       *uringRW // nil unless EnableURing succeeded
+	// controlSpace is the size of the control buffer of every read slot
+	controlSpace int
 }
 
 func NewRW(fd, n, mtu int) *ReaderWriter {
 	rw := &ReaderWriter{}
 	rw.fd = fd
 	rw.mtu = mtu
-	rw.msgs, rw.buffers, rw.names = prepare(n, mtu)
+	rw.msgs, rw.iovs, rw.buffers, rw.names = prepare(n, mtu)
+	rw.controls = make([][]byte, n)
+	// options set on the socket before, such as SocketOptions.Timestamps
+	if on, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPNS); err == nil && on != 0 {
+		rw.addControl(unix.CmsgSpace(int(unsafe.Sizeof(unix.Timespec{}))))
+	}
+	if on, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RXQ_OVFL); err == nil && on != 0 {
+		rw.addControl(unix.CmsgSpace(4))
+	}
+	if ipOptionEnabled(fd, optRecvTOS) {
+		rw.addControl(unix.CmsgSpace(4))
+	}
+	if ipOptionEnabled(fd, optRecvTTL) {
+		rw.addControl(unix.CmsgSpace(4))
+	}
 	rw.remoteAddr = &net.UDPAddr{}
 	return rw
 }
 
-func (rw *ReaderWriter) ReadFrom(readFunc func([]byte, *net.UDPAddr, error)) {
+// ReadFrom reads a batch of datagrams and calls readFunc for each of them,
+// data and addr are reused by the next datagram. It returns the number of
+// datagrams read, 0 when the socket has nothing more to read.
+func (rw *ReaderWriter) ReadFrom(readFunc func([]byte, *net.UDPAddr, error)) int {
+	if rw.ring != nil {
+		return rw.readURing(func(data []byte, addr netip.AddrPort, err error) {
+			if err != nil {
+				readFunc(nil, nil, err)
+				return
+			}
+
+			readFunc(data, rw.udpAddr(addr), nil)
+		})
+	}
+
 	n, err := rw.read()
 	if err != nil {
 		readFunc(nil, nil, err)
-		return
+		return 0
 	}
 
+	delivered := 0
 	for i := 0; i < n; i++ {
-		familyData := rw.names[i][:2]
-		afNet := (*sockaddrFamily)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&familyData)).Data))
-		switch afNet.Family {
-		case unix.AF_INET:
-			rw.names[i][2], rw.names[i][3] = rw.names[i][3], rw.names[i][2] //字节序转换
-			sockaddrInet := (*unix.RawSockaddrInet4)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&rw.names[i])).Data))
-			rw.remoteAddr.IP = sockaddrInet.Addr[:]
-			rw.remoteAddr.Port = int(sockaddrInet.Port)
-		case unix.AF_INET6:
-			rw.names[i][2], rw.names[i][3] = rw.names[i][3], rw.names[i][2] //字节序转换
-			sockaddrInet6 := (*unix.RawSockaddrInet6)(unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&rw.names[i])).Data))
-			rw.remoteAddr.IP = sockaddrInet6.Addr[:]
-			rw.remoteAddr.Port = int(sockaddrInet6.Port)
-			rw.remoteAddr.Zone = rw.zoneID2String(int(sockaddrInet6.Scope_id))
-		default:
-			err := fmt.Errorf("unknown net family")
+		addr, err := rw.addrPort(i)
+		if err != nil {
 			readFunc(nil, nil, err)
-			return
+			return delivered
+		}
+
+		remoteAddr := rw.udpAddr(addr)
+		rw.slot = i
+		rw.parseControl(rw.control(i), &rw.cm)
+		for data := rw.buffers[i][:rw.msgs[i].Len]; len(data) > 0; delivered++ {
+			rw.cur, data = rw.segment(data)
+			readFunc(rw.cur, remoteAddr, nil)
+		}
+	}
+
+	return delivered
+}
+
+// udpAddr converts addr into rw.remoteAddr.
+func (rw *ReaderWriter) udpAddr(addr netip.AddrPort) *net.UDPAddr {
+	ip := addr.Addr()
+	if ip.Is4() {
+		b := ip.As4()
+		copy(rw.remoteIP[:], b[:])
+		rw.remoteAddr.IP = rw.remoteIP[:4]
+	} else {
+		rw.remoteIP = ip.As16()
+		rw.remoteAddr.IP = rw.remoteIP[:]
+	}
+	rw.remoteAddr.Port = int(addr.Port())
+	rw.remoteAddr.Zone = ip.Zone()
+	return rw.remoteAddr
+}
+
+// ReadFromAddrPort is ReadFrom with netip.AddrPort, addr is a value which is safe
+// to retain, data is reused by the next batch. With io_uring enabled they only
+// deliver the datagrams the ring received so far, see WaitURing.
+func (rw *ReaderWriter) ReadFromAddrPort(readFunc func([]byte, netip.AddrPort, error)) int {
+	if rw.ring != nil {
+		return rw.readURing(readFunc)
+	}
+
+	n, err := rw.read()
+	if err != nil {
+		readFunc(nil, netip.AddrPort{}, err)
+		return 0
+	}
+
+	delivered := 0
+	for i := 0; i < n; i++ {
+		addr, err := rw.addrPort(i)
+		if err != nil {
+			readFunc(nil, netip.AddrPort{}, err)
+			return delivered
 		}
 
-		readFunc(rw.buffers[i][:rw.msgs[i].Len], rw.remoteAddr, nil)
+		rw.slot = i
+		rw.parseControl(rw.control(i), &rw.cm)
+		for data := rw.buffers[i][:rw.msgs[i].Len]; len(data) > 0; delivered++ {
+			rw.cur, data = rw.segment(data)
+			readFunc(rw.cur, addr, nil)
+		}
+	}
+
+	return delivered
+}
+
+// segment cuts the next datagram from the head of data, a buffer coalesced by
+// GRO holds several of them. Datagrams are truncated to mtu.
+func (rw *ReaderWriter) segment(data []byte) ([]byte, []byte) {
+	n := len(data)
+	if rw.cm.SegmentSize > 0 && n > rw.cm.SegmentSize {
+		n = rw.cm.SegmentSize
+	}
+
+	datagram := data[:n]
+	if len(datagram) > rw.mtu {
+		datagram = datagram[:rw.mtu]
+	}
+
+	return datagram, data[n:]
+}
+
+// Detach hands a buffer holding the datagram being delivered, at its start,
+// over to the caller, fresh must hold at least mtu bytes. The read buffer itself
+// is handed over and replaced by fresh, unless it's shared by the datagrams of a
+// GRO buffer or to the buffer ring of io_uring: the datagram is copied into
+// fresh then. It must only be called from inside the read callback.
+func (rw *ReaderWriter) Detach(fresh []byte) []byte {
+	if rw.gro || rw.ring != nil {
+		copy(fresh, rw.cur)
+		return fresh
+	}
+
+	i := rw.slot
+	buf := rw.buffers[i]
+	rw.buffers[i] = fresh
+	rw.iovs[i].Base = (*byte)(unsafe.Pointer(&fresh[0]))
+	rw.iovs[i].Len = uint64(len(fresh))
+	return buf
+}
+
+func (rw *ReaderWriter) addrPort(i int) (netip.AddrPort, error) {
+	return rw.sockaddrAddrPort(unsafe.Pointer(&rw.names[i][0]))
+}
 
-		if afNet.Family == unix.AF_INET6 {
-			copy(rw.dc[:], zero[:])
+// sockaddrAddrPort converts the raw sockaddr at name.
+func (rw *ReaderWriter) sockaddrAddrPort(name unsafe.Pointer) (netip.AddrPort, error) {
+	switch (*sockaddrFamily)(name).Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(name)
+		return netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), ntohs(sa.Port)), nil
+	case unix.AF_INET6:
+		sa := (*unix.RawSockaddrInet6)(name)
+		// the IPv4 peers of a dual-stack socket are v4-mapped
+		ip := netip.AddrFrom16(sa.Addr).Unmap()
+		if sa.Scope_id != 0 {
+			ip = ip.WithZone(rw.zoneID2String(int(sa.Scope_id)))
 		}
+		return netip.AddrPortFrom(ip, ntohs(sa.Port)), nil
 	}
+
+	return netip.AddrPort{}, fmt.Errorf("unknown net family")
+}
+
+// ntohs converts a port in network byte order.
+func ntohs(port uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+func htons(port uint16) uint16 {
+	var n uint16
+	b := (*[2]byte)(unsafe.Pointer(&n))
+	b[0] = byte(port >> 8)
+	b[1] = byte(port)
+	return n
 }
 
 // See: https://www.man7.org/linux/man-pages/man2/recvmmsg.2.html
 func (rw *ReaderWriter) read() (int, error) {
+	// msg_namelen and msg_controllen are value-result arguments, restore them
+	// before every call
+	for i := range rw.msgs {
+		rw.msgs[i].Hdr.Namelen = uint32(len(rw.names[i]))
+		rw.msgs[i].Hdr.Controllen = uint64(rw.controlSpace)
+	}
+
 	n, _, err := unix.Syscall6(unix.SYS_RECVMMSG, uintptr(rw.fd),
 		uintptr(unsafe.Pointer(&rw.msgs[0])), uintptr(len(rw.msgs)), unix.MSG_WAITFORONE,
 		0, 0,
@@ -89,7 +258,7 @@ func (rw *ReaderWriter) read() (int, error) {
 			return 0, nil
 		}
 
-		return 0, os.NewSyscallError("recvmmsg", fmt.Errorf("%v", unix.ErrnoName(err)))
+		return 0, os.NewSyscallError("recvmmsg", err)
 	}
 
 	return int(n), nil
@@ -143,114 +312,297 @@ func (rw *ReaderWriter) string2ZoneID(zone string) uint32 {
 }
 
 func (rw *ReaderWriter) WriteTo(data []byte, addr *net.UDPAddr) error {
-	if addr == nil || data == nil {
+	if addr == nil {
+		return fmt.Errorf("writeto: data or addr invalid")
+	}
+
+	return rw.WriteToAddrPort(data, AddrPortOf(addr))
+}
+
+// WriteToAddrPort may be called from several goroutines, so the sockaddr lives on the stack.
+func (rw *ReaderWriter) WriteToAddrPort(data []byte, addr netip.AddrPort) error {
+	if !addr.IsValid() || len(data) == 0 {
 		return fmt.Errorf("writeto: data or addr invalid")
 	}
 
 	if len(data) > rw.mtu {
-		return fmt.Errorf("writeto: data length too long")
+		return rw.tooLong(addr)
 	}
 
-	if addr.IP.To4() == nil {
-		return rw.writeToIPv6(data, addr)
+	var sa unix.RawSockaddrInet6
+	salen := rw.putSockaddr(&sa, addr)
+	return rw.writeto(data, unsafe.Pointer(&sa), salen)
+}
+
+// Write sends data on a connected socket.
+func (rw *ReaderWriter) Write(data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("write: data invalid")
+	}
+
+	if len(data) > rw.mtu {
+		return rw.tooLong(netip.AddrPort{})
 	}
 
-	return rw.writeToIPv4(data, addr)
+	return rw.writeto(data, nil, 0)
 }
 
-func (rw *ReaderWriter) writeToIPv4(data []byte, addr *net.UDPAddr) error {
-	rw.sockaddr4.Family = unix.AF_INET
-	port := (*[2]byte)(unsafe.Pointer(&rw.sockaddr4.Port))
-	port[0] = byte(addr.Port >> 8)
-	port[1] = byte(addr.Port)
+// WriteMsg sends msg with its cmsgs by sendmsg, a zero Addr is only valid on
+// a connected socket.
+func (rw *ReaderWriter) WriteMsg(msg *Mmsg) error {
+	if len(msg.Data) == 0 {
+		return fmt.Errorf("writemsg: data invalid")
+	}
 
-	copy(rw.sockaddr4.Addr[:], addr.IP)
+	if len(msg.Data) > rw.mtu {
+		return rw.tooLong(msg.Addr)
+	}
 
-	return rw.writeto(uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), uintptr(0), uintptr(unsafe.Pointer(&rw.sockaddr4)), uintptr(unix.SizeofSockaddrInet4))
+	var sa unix.RawSockaddrInet6
+	var control [128]byte
+	iov := iovec{Base: &msg.Data[0], Len: uint64(len(msg.Data))}
+	hdr := msghdr{Iov: &iov, Iovlen: 1}
+	if msg.Addr.IsValid() {
+		hdr.Name = (*byte)(unsafe.Pointer(&sa))
+		hdr.Namelen = rw.putSockaddr(&sa, msg.Addr)
+	}
+
+	if msg.hasControl() {
+		hdr.Control = &control[0]
+		hdr.Controllen = uint64(putControl(control[:], msg, 0))
+	}
+
+	if rw.zeroCopied(msg) {
+		rw.zc.Lock()
+		defer rw.zc.Unlock()
+	}
+
+	_, _, err := unix.Syscall(unix.SYS_SENDMSG, uintptr(rw.fd), uintptr(unsafe.Pointer(&hdr)), uintptr(rw.sendFlags(msg)))
+	if err != 0 {
+		return os.NewSyscallError("sendmsg", err)
+	}
+
+	switch {
+	case rw.zeroCopied(msg):
+		rw.zc.add(rw.zc.next, msg.Done)
+		rw.zc.next++
+	case msg.Done != nil:
+		msg.Done()
+	}
+
+	return nil
 }
 
-func (rw *ReaderWriter) writeToIPv6(data []byte, addr *net.UDPAddr) error {
-	rw.sockaddr6.Family = unix.AF_INET6
-	rw.sockaddr6.Scope_id = rw.string2ZoneID(addr.Zone)
-	port := (*[2]byte)(unsafe.Pointer(&rw.sockaddr6.Port))
-	port[0] = byte(addr.Port >> 8)
-	port[1] = byte(addr.Port)
+// sendFlags returns the flags of the send of msg.
+func (rw *ReaderWriter) sendFlags(msg *Mmsg) int {
+	if rw.zeroCopied(msg) {
+		return unix.MSG_ZEROCOPY
+	}
+
+	return 0
+}
 
-	copy(rw.sockaddr6.Addr[:], addr.IP)
+// putSockaddr stores addr into sa, which is large enough for both families,
+// and returns the length of the sockaddr.
+func (rw *ReaderWriter) putSockaddr(sa *unix.RawSockaddrInet6, addr netip.AddrPort) uint32 {
+	// a sockaddr_in is accepted by dual-stack sockets too
+	ip := addr.Addr().Unmap()
+	if ip.Is4() {
+		sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(sa))
+		sa4.Family = unix.AF_INET
+		sa4.Port = htons(addr.Port())
+		sa4.Addr = ip.As4()
+		return unix.SizeofSockaddrInet4
+	}
 
-	return rw.writeto(uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), uintptr(0), uintptr(unsafe.Pointer(&rw.sockaddr6)), uintptr(unix.SizeofSockaddrInet6))
+	sa.Family = unix.AF_INET6
+	sa.Port = htons(addr.Port())
+	sa.Addr = ip.As16()
+	sa.Scope_id = rw.string2ZoneID(ip.Zone())
+	return unix.SizeofSockaddrInet6
 }
 
-func (rw *ReaderWriter) writeto(data uintptr, dataLen uintptr, flags uintptr, sockaddr uintptr, sockaddrSize uintptr) error {
-	_, _, err := unix.Syscall6(unix.SYS_SENDTO, uintptr(rw.fd), data, dataLen, flags, sockaddr, sockaddrSize)
+// writeto sends data to the sockaddr sa, nil on a connected socket. The pointers
+// only become uintptr in the syscall expression, so that a stack move during the
+// call can't leave the kernel a stale address.
+func (rw *ReaderWriter) writeto(data []byte, sa unsafe.Pointer, salen uint32) error {
+	_, _, err := unix.Syscall6(unix.SYS_SENDTO, uintptr(rw.fd), uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), 0, uintptr(sa), uintptr(salen))
 	if err != 0 {
-		return os.NewSyscallError("sendto", fmt.Errorf("%v", unix.ErrnoName(err)))
+		return os.NewSyscallError("sendto", err)
 	}
 
 	return nil
 }
 
+// WriteToN sends mmsgs in order and returns how many of them were sent, an error
+// is only reported when not even the first one could be sent. With GSO enabled
+// consecutive datagrams to the same address are coalesced. A datagram longer than
+// the MTU of rw fails with an EMSGSIZE *PeerError.
 // See: https://man7.org/linux/man-pages/man2/sendmmsg.2.html
 func (rw *ReaderWriter) WriteToN(mmsgs ...*Mmsg) (int, error) {
-	writed := 0
+	if len(mmsgs) == 0 {
+		return 0, nil
+	}
+
+	// a datagram longer than mtu ends the batch, it fails once it's the first
+	for i, msg := range mmsgs {
+		if len(msg.Data) > rw.mtu {
+			if i == 0 {
+				return 0, rw.tooLong(msg.Addr)
+			}
+
+			mmsgs = mmsgs[:i]
+			break
+		}
+	}
+
+	sent := 0
+	for sent < len(mmsgs) {
+		// MSG_ZEROCOPY applies to every message of a sendmmsg, so a call only
+		// holds datagrams of one mode
+		end := sent + 1
+		for end < len(mmsgs) && rw.zeroCopied(mmsgs[end]) == rw.zeroCopied(mmsgs[sent]) {
+			end++
+		}
+
+		n, err := rw.writeToN(mmsgs[sent:end])
+		sent += n
+		if err != nil {
+			if sent > 0 {
+				return sent, nil
+			}
+
+			return 0, err
+		}
+
+		if sent < end {
+			break
+		}
+	}
+
+	return sent, nil
+}
+
+// writeToN is WriteToN for datagrams which are all sent with or all without
+// MSG_ZEROCOPY.
+func (rw *ReaderWriter) writeToN(mmsgs []*Mmsg) (int, error) {
+	gso := rw.GSO()
+	n, err := rw.sendmmsg(mmsgs, gso)
+	if err != nil && gso && gsoRun(mmsgs) > 1 && (isGSOUnsupported(err) || errors.Is(err, unix.EINVAL)) {
+		if isGSOUnsupported(err) {
+			atomic.StoreInt32(&rw.gso, 0)
+		}
+
+		// the route may still reject the segments, e.g. when they exceed its MTU,
+		// send them one by one this time
+		n, err = rw.sendmmsg(mmsgs, false)
+	}
+
+	return n, err
+}
+
+func (rw *ReaderWriter) sendmmsg(mmsgs []*Mmsg, gso bool) (int, error) {
 	n := len(mmsgs)
-	mms := make([]mmsghdr, n)
-	for i := 0; i < n; i++ {
+	mms := make([]mmsghdr, 0, n)
+	runs := make([]int, 0, n) // datagrams coalesced into every message
+	names := make([]unix.RawSockaddrInet6, n)
+	iovs := make([]iovec, n)
+	var control []byte
+	space := sendControlSpace
+	for i := 0; i < n; {
+		run := 1
+		if gso {
+			run = gsoRun(mmsgs[i:])
+		}
+
+		var mm mmsghdr
 		msg := mmsgs[i]
-		if msg.Addr.IP.To4() == nil { // IPv6
-			sockaddrInet6 := &unix.RawSockaddrInet6{}
-			sockaddrInet6.Family = unix.AF_INET6
-			sockaddrInet6.Scope_id = rw.string2ZoneID(msg.Addr.Zone)
-			port := (*[2]byte)(unsafe.Pointer(&sockaddrInet6.Port))
-			port[0] = byte(msg.Addr.Port >> 8)
-			port[1] = byte(msg.Addr.Port)
-			copy(sockaddrInet6.Addr[:], msg.Addr.IP)
-
-			l := unsafe.Sizeof(*sockaddrInet6)
-			m := &reflect.SliceHeader{
-				Data: uintptr(unsafe.Pointer(sockaddrInet6)),
-				Cap:  int(l),
-				Len:  int(l),
+		// a zero Addr is only valid on a connected socket
+		if msg.Addr.IsValid() {
+			name := &names[len(mms)]
+			mm.Hdr.Name = (*byte)(unsafe.Pointer(name))
+			mm.Hdr.Namelen = rw.putSockaddr(name, msg.Addr)
+		}
+
+		for j := i; j < i+run; j++ {
+			iovs[j].Base = (*byte)(unsafe.Pointer(&mmsgs[j].Data[0]))
+			iovs[j].Len = uint64(len(mmsgs[j].Data))
+		}
+		mm.Hdr.Iov = &iovs[i]
+		mm.Hdr.Iovlen = uint64(run)
+
+		if run > 1 || msg.hasControl() {
+			if control == nil {
+				control = make([]byte, n*space)
 			}
-			name := *(*[]byte)(unsafe.Pointer(m))
-			mms[i].Hdr.Name = (*byte)(unsafe.Pointer(&name[0]))
-			mms[i].Hdr.Namelen = uint32(len(name))
 
-			if len(msg.Data) > rw.mtu {
-				msg.Data = msg.Data[:rw.mtu]
+			segment := 0
+			if run > 1 {
+				segment = len(msg.Data)
 			}
-		} else { // IPv4
-			sockaddrInet4 := &unix.RawSockaddrInet4{}
-			sockaddrInet4.Family = unix.AF_INET
-			port := (*[2]byte)(unsafe.Pointer(&sockaddrInet4.Port))
-			port[0] = byte(msg.Addr.Port >> 8)
-			port[1] = byte(msg.Addr.Port)
-			copy(rw.sockaddr4.Addr[:], msg.Addr.IP)
-
-			l := unsafe.Sizeof(*sockaddrInet4)
-			m := &reflect.SliceHeader{
-				Data: uintptr(unsafe.Pointer(sockaddrInet4)),
-				Cap:  int(l),
-				Len:  int(l),
+
+			c := control[len(mms)*space : (len(mms)+1)*space]
+			mm.Hdr.Control = &c[0]
+			mm.Hdr.Controllen = uint64(putControl(c, msg, segment))
+		}
+
+		mms = append(mms, mm)
+		runs = append(runs, run)
+		i += run
+	}
+
+	// sendmmsg returns the number of messages sent, an error is only reported
+	// when not even the first message could be sent.
+	zc := rw.zeroCopied(mmsgs[0])
+	if zc {
+		rw.zc.Lock()
+		defer rw.zc.Unlock()
+	}
+
+	sent, err := rw.send(mms, rw.sendFlags(mmsgs[0]))
+	if err != nil {
+		return 0, err
+	}
+
+	// every message sent takes a zero-copy id, its datagrams complete together
+	datagrams := 0
+	for _, run := range runs[:sent] {
+		for _, msg := range mmsgs[datagrams : datagrams+run] {
+			switch {
+			case zc:
+				rw.zc.add(rw.zc.next, msg.Done)
+			case msg.Done != nil:
+				msg.Done()
 			}
-			name := *(*[]byte)(unsafe.Pointer(m))
-			mms[i].Hdr.Name = (*byte)(unsafe.Pointer(&name[0]))
-			mms[i].Hdr.Namelen = uint32(len(name))
 		}
 
-		v := []iovec{
-			{Base: (*byte)(unsafe.Pointer(&msg.Data[0])), Len: uint64(len(msg.Data))},
+		if zc {
+			rw.zc.next++
 		}
+		datagrams += run
+	}
+
+	return datagrams, nil
+}
 
-		mms[i].Hdr.Iov = &v[0]
-		mms[i].Hdr.Iovlen = uint64(len(v))
-		writed++
+// send passes mms to sendmmsg, or to linked sendmsg when io_uring is enabled.
+// It returns the number of messages sent, an error is only reported when not
+// even the first one could be sent.
+func (rw *ReaderWriter) send(mms []mmsghdr, flags int) (int, error) {
+	if rw.ring != nil {
+		n, err := rw.ring.sendmsg(rw.fd, mms, flags)
+		if err != errURingClosed {
+			if n > 0 {
+				err = nil
+			}
+			return n, err
+		}
 	}
 
-	_, _, err := unix.Syscall6(unix.SYS_SENDMMSG, uintptr(rw.fd), uintptr(unsafe.Pointer(&mms[0])), uintptr(len(mms)), uintptr(0), 0, 0)
-	if err != 0 {
-		return 0, os.NewSyscallError("sendmmsg", fmt.Errorf("%v", unix.ErrnoName(err)))
+	n, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, uintptr(rw.fd), uintptr(unsafe.Pointer(&mms[0])), uintptr(len(mms)), uintptr(flags), 0, 0)
+	if errno != 0 {
+		return 0, os.NewSyscallError("sendmmsg", errno)
 	}
 
-	return writed, nil
+	return int(n), nil
 }
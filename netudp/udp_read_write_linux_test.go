@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readRW reads datagrams from rw until n arrived or none came for a while.
+func readRW(t *testing.T, rw *ReaderWriter, n int) [][]byte {
+	t.Helper()
+	var datagrams [][]byte
+	deadline := time.Now().Add(2 * time.Second)
+	for len(datagrams) < n && time.Now().Before(deadline) {
+		fds := []unix.PollFd{{Fd: int32(rw.fd), Events: unix.POLLIN}}
+		unix.Poll(fds, 100)
+		rw.ReadFromAddrPort(func(data []byte, addr netip.AddrPort, err error) {
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			datagrams = append(datagrams, append([]byte(nil), data...))
+		})
+	}
+
+	return datagrams
+}
+
+func TestSegment(t *testing.T) {
+	tests := []struct {
+		name        string
+		segmentSize int
+		mtu         int
+		length      int
+		want        []int
+	}{
+		{"not coalesced", 0, 1500, 1000, []int{1000}},
+		{"truncated to mtu", 0, 1500, 2000, []int{1500}},
+		{"segments", 500, 1500, 1500, []int{500, 500, 500}},
+		{"shorter last", 500, 1500, 1200, []int{500, 500, 200}},
+		{"one segment", 500, 1500, 300, []int{300}},
+		{"segments truncated to mtu", 1000, 600, 2500, []int{600, 600, 500}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := &ReaderWriter{mtu: tt.mtu}
+			rw.cm.SegmentSize = tt.segmentSize
+			data := make([]byte, tt.length)
+			for i := range data {
+				data[i] = byte(i)
+			}
+
+			var got []int
+			offset := 0
+			for len(data) > 0 {
+				var datagram []byte
+				n := len(data)
+				datagram, data = rw.segment(data)
+				if len(datagram) > 0 && datagram[0] != byte(offset) {
+					t.Fatalf("datagram %d starts at %d, want %d", len(got), datagram[0], byte(offset))
+				}
+				offset += n - len(data)
+				got = append(got, len(datagram))
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("segment() cut %v, want %v", got, tt.want)
+			}
+
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("segment() cut %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGROLoopback(t *testing.T) {
+	sender, _ := newTestRW(t, "udp4", "127.0.0.1:0", SocketOptions{})
+	receiver, addr := newTestRW(t, "udp4", "127.0.0.1:0", SocketOptions{})
+	if !receiver.EnableGRO() {
+		t.Skip("UDP_GRO isn't supported")
+	}
+
+	// a segmented send reaches a GRO socket coalesced
+	sender.EnableGSO()
+	mmsgs := testMmsgs(addr, 400, 400, 400, 400, 150)
+	if n, err := sender.WriteToN(mmsgs...); err != nil || n != len(mmsgs) {
+		t.Fatalf("WriteToN() = %d, %v, want %d", n, err, len(mmsgs))
+	}
+
+	datagrams := readRW(t, receiver, len(mmsgs))
+	if len(datagrams) != len(mmsgs) {
+		t.Fatalf("received %d datagrams, want %d", len(datagrams), len(mmsgs))
+	}
+
+	for i, d := range datagrams {
+		if !bytes.Equal(d, mmsgs[i].Data) {
+			t.Fatalf("datagram %d has %d bytes, want %d bytes of %d", i, len(d), len(mmsgs[i].Data), i)
+		}
+	}
+}
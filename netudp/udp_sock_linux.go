@@ -1,34 +1,44 @@
+//go:build linux
 // +build linux
 
 package netudp
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
-func NewUDPSocket(network, addr string, reusePort bool) (int, unix.Sockaddr, error) {
-	var sa unix.Sockaddr
+// NewUDPSocket creates a socket bound to addr. The "udp" network with a
+// wildcard address makes a dual-stack IPv6 socket, see SocketOptions.V6Only.
+func NewUDPSocket(network, addr string, opts SocketOptions) (int, unix.Sockaddr, error) {
 	udpAddr, err := net.ResolveUDPAddr(network, addr)
 	if err != nil {
 		return 0, nil, fmt.Errorf("resolve addr err: %v", err)
 	}
 
-	netFamily := unix.AF_INET
-	if udpAddr.IP.To4() == nil {
-		netFamily = unix.AF_INET6
+	netFamily, v6only, err := socketFamily(network, udpAddr.IP, opts.V6Only)
+	if err != nil {
+		return 0, nil, err
 	}
 
-	syscall.ForkLock.Lock()
-	fd, err := unix.Socket(netFamily, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
-	if err == nil {
-		unix.CloseOnExec(fd)
+	fd, err := newSocket(netFamily)
+	if err != nil && network == "udp" && netFamily == unix.AF_INET6 && (udpAddr.IP == nil || udpAddr.IP.IsUnspecified()) &&
+		errors.Is(err, unix.EAFNOSUPPORT) {
+		// the host has no IPv6, a wildcard "udp" socket serves IPv4 only
+		netFamily = unix.AF_INET
+		fd, err = newSocket(netFamily)
+	}
+
+	if err != nil {
+		return 0, nil, err
 	}
-	syscall.ForkLock.Unlock()
 
 	defer func() {
 		if err != nil {
@@ -36,19 +46,20 @@ func NewUDPSocket(network, addr string, reusePort bool) (int, unix.Sockaddr, err
 		}
 	}()
 
-	switch network {
-	case "udp":
-		sockaddr := &unix.SockaddrInet4{}
-		sockaddr.Port = udpAddr.Port
-		sa = sockaddr
-	case "udp4":
+	var sa unix.Sockaddr
+	if netFamily == unix.AF_INET {
+		network = "udp4"
 		sockaddr := &unix.SockaddrInet4{}
 		sockaddr.Port = udpAddr.Port
 		copy(sockaddr.Addr[:], udpAddr.IP.To4())
 		sa = sockaddr
-	case "udp6":
+	} else {
+		network = "udp6"
 		sockaddr := &unix.SockaddrInet6{}
-		copy(sockaddr.Addr[:], udpAddr.IP.To16())
+		// 0.0.0.0 is the wildcard of a dual-stack socket too
+		if !udpAddr.IP.IsUnspecified() {
+			copy(sockaddr.Addr[:], udpAddr.IP.To16())
+		}
 		if udpAddr.Zone != "" {
 			var iface *net.Interface
 			iface, err = net.InterfaceByName(udpAddr.Zone)
@@ -58,20 +69,196 @@ func NewUDPSocket(network, addr string, reusePort bool) (int, unix.Sockaddr, err
 			sockaddr.ZoneId = uint32(iface.Index)
 		}
 		sockaddr.Port = udpAddr.Port
-		netFamily = unix.AF_INET6
-	default:
-		return 0, nil, fmt.Errorf("not support network")
-	}
+		sa = sockaddr
 
-	if reusePort {
-		if err = os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)); err != nil {
+		// set either way, net.ipv6.bindv6only changes the default
+		if err = os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, boolint(v6only))); err != nil {
 			return 0, nil, err
 		}
 	}
 
+	if err = applySocketOptions(fd, network, addr, opts); err != nil {
+		return 0, nil, err
+	}
+
 	if err = os.NewSyscallError("bind", unix.Bind(fd, sa)); err != nil {
 		return 0, nil, err
 	}
 
 	return fd, sa, nil
 }
+
+// NewConnectedUDPSocket creates a socket connected to addr, the kernel picks its
+// local address. It returns the socket and the resolved remote address.
+func NewConnectedUDPSocket(network, addr string, opts SocketOptions) (int, netip.AddrPort, error) {
+	udpAddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return 0, netip.AddrPort{}, fmt.Errorf("resolve addr err: %v", err)
+	}
+
+	remote := AddrPortOf(udpAddr)
+	netFamily, sa, err := sockaddrOf(remote)
+	if err != nil {
+		return 0, netip.AddrPort{}, err
+	}
+
+	fd, err := newSocket(netFamily)
+	if err != nil {
+		return 0, netip.AddrPort{}, err
+	}
+
+	if err = applySocketOptions(fd, network, addr, opts); err == nil {
+		err = os.NewSyscallError("connect", unix.Connect(fd, sa))
+	}
+
+	if err != nil {
+		unix.Close(fd)
+		return 0, netip.AddrPort{}, err
+	}
+
+	return fd, remote, nil
+}
+
+// socketFamily returns the family of a socket of network bound to ip and
+// whether an IPv6 one is IPv6-only.
+func socketFamily(network string, ip net.IP, v6only V6Only) (int, bool, error) {
+	switch network {
+	case "udp4":
+		return unix.AF_INET, false, nil
+	case "udp6":
+		return unix.AF_INET6, v6only != V6OnlyOff, nil
+	case "udp":
+		if ip != nil && !ip.IsUnspecified() && ip.To4() != nil {
+			return unix.AF_INET, false, nil
+		}
+
+		return unix.AF_INET6, v6only == V6OnlyOn, nil
+	}
+
+	return 0, false, fmt.Errorf("not support network")
+}
+
+// sockaddrOf converts addr for connect(2) and returns its family.
+func sockaddrOf(addr netip.AddrPort) (int, unix.Sockaddr, error) {
+	addr = UnmapAddrPort(addr)
+	if addr.Addr().Is4() {
+		return unix.AF_INET, &unix.SockaddrInet4{Port: int(addr.Port()), Addr: addr.Addr().As4()}, nil
+	}
+
+	sa := &unix.SockaddrInet6{Port: int(addr.Port()), Addr: addr.Addr().As16()}
+	if zone := addr.Addr().Zone(); zone != "" {
+		iface, err := net.InterfaceByName(zone)
+		if err != nil {
+			return 0, nil, fmt.Errorf("parse UDPAddr.Zone err: %v", err)
+		}
+		sa.ZoneId = uint32(iface.Index)
+	}
+
+	return unix.AF_INET6, sa, nil
+}
+
+// SockaddrToAddrPort converts an address returned by getsockname(2), IPv4-mapped
+// IPv6 addresses are unmapped.
+func SockaddrToAddrPort(sa unix.Sockaddr) netip.AddrPort {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), uint16(sa.Port))
+	case *unix.SockaddrInet6:
+		ip := netip.AddrFrom16(sa.Addr).Unmap()
+		if sa.ZoneId != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+				ip = ip.WithZone(ifi.Name)
+			}
+		}
+		return netip.AddrPortFrom(ip, uint16(sa.Port))
+	}
+
+	return netip.AddrPort{}
+}
+
+func newSocket(netFamily int) (int, error) {
+	syscall.ForkLock.Lock()
+	fd, err := unix.Socket(netFamily, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	if err == nil {
+		unix.CloseOnExec(fd)
+	}
+	syscall.ForkLock.Unlock()
+
+	return fd, os.NewSyscallError("socket", err)
+}
+
+// applySocketOptions sets opts on fd, which is about to be bound to or connected
+// to address, and calls opts.Control last.
+func applySocketOptions(fd int, network, address string, opts SocketOptions) error {
+	// IP_TOS resets SO_PRIORITY, it goes first
+	if err := applyIPOptions(fd, opts); err != nil {
+		return err
+	}
+
+	options := []struct {
+		opt   int
+		value int
+	}{
+		{unix.SO_REUSEPORT, boolint(opts.ReusePort)},
+		{unix.SO_TIMESTAMPNS, boolint(opts.Timestamps)},
+		{unix.SO_RXQ_OVFL, boolint(opts.RecvDrops)},
+		{unix.SO_PRIORITY, opts.Priority},
+		{unix.SO_MARK, opts.Mark},
+		{unix.SO_BUSY_POLL, int(opts.BusyPoll / time.Microsecond)},
+	}
+
+	for _, o := range options {
+		if o.value <= 0 {
+			continue
+		}
+
+		if err := os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.SOL_SOCKET, o.opt, o.value)); err != nil {
+			return err
+		}
+	}
+
+	if opts.ReadBuffer > 0 {
+		if err := setBuffer(fd, unix.SO_RCVBUF, unix.SO_RCVBUFFORCE, opts.ReadBuffer, opts.ForceBuffers); err != nil {
+			return err
+		}
+	}
+
+	if opts.WriteBuffer > 0 {
+		if err := setBuffer(fd, unix.SO_SNDBUF, unix.SO_SNDBUFFORCE, opts.WriteBuffer, opts.ForceBuffers); err != nil {
+			return err
+		}
+	}
+
+	if opts.BindToDevice != "" {
+		if err := os.NewSyscallError("setsockopt", unix.BindToDevice(fd, opts.BindToDevice)); err != nil {
+			return err
+		}
+	}
+
+	// IP_FREEBIND also applies to IPv6 sockets
+	if opts.FreeBind {
+		if err := os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_FREEBIND, 1)); err != nil {
+			return err
+		}
+	}
+
+	if opts.Control != nil {
+		return opts.Control(network, address, rawConn(fd))
+	}
+
+	return nil
+}
+
+// setBuffer sets the buffer size option opt of fd. With force forceOpt is tried
+// first, it ignores net.core.rmem_max and net.core.wmem_max but needs
+// CAP_NET_ADMIN, without it the size is capped.
+func setBuffer(fd, opt, forceOpt, size int, force bool) error {
+	if force {
+		err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, forceOpt, size)
+		if !errors.Is(err, unix.EPERM) {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.SOL_SOCKET, opt, size))
+}
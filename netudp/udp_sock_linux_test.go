@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSocketFamily(t *testing.T) {
+	tests := []struct {
+		network string
+		ip      net.IP
+		v6only  V6Only
+		family  int
+		want    bool
+	}{
+		{"udp4", nil, V6OnlyDefault, unix.AF_INET, false},
+		{"udp6", nil, V6OnlyDefault, unix.AF_INET6, true},
+		{"udp6", nil, V6OnlyOff, unix.AF_INET6, false},
+		// a wildcard "udp" socket is dual-stack unless V6OnlyOn
+		{"udp", nil, V6OnlyDefault, unix.AF_INET6, false},
+		{"udp", net.IPv4zero, V6OnlyDefault, unix.AF_INET6, false},
+		{"udp", net.IPv6unspecified, V6OnlyOn, unix.AF_INET6, true},
+		{"udp", net.IPv4(127, 0, 0, 1), V6OnlyOff, unix.AF_INET, false},
+		{"udp", net.IPv6loopback, V6OnlyDefault, unix.AF_INET6, false},
+	}
+
+	for _, tt := range tests {
+		family, v6only, err := socketFamily(tt.network, tt.ip, tt.v6only)
+		if err != nil || family != tt.family || v6only != tt.want {
+			t.Errorf("socketFamily(%q, %v, %v) = %d, %v, %v, want %d, %v", tt.network, tt.ip, tt.v6only, family, v6only, err, tt.family, tt.want)
+		}
+	}
+
+	if _, _, err := socketFamily("tcp", nil, V6OnlyDefault); err == nil {
+		t.Errorf("socketFamily of tcp succeeded")
+	}
+}
@@ -0,0 +1,87 @@
+package netudp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// ListenUDP listens on addr with the options of opts windows has: ReadBuffer,
+// WriteBuffer and Control.
+func ListenUDP(network, addr string, opts SocketOptions) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: opts.Control}
+	c, err := lc.ListenPacket(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := c.(*net.UDPConn)
+	if err := setBuffers(conn, opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// DialUDP connects to addr with the options of opts windows has.
+func DialUDP(network, addr string, opts SocketOptions) (*net.UDPConn, error) {
+	d := net.Dialer{Control: opts.Control}
+	c, err := d.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := c.(*net.UDPConn)
+	if err := setBuffers(conn, opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func setBuffers(conn *net.UDPConn, opts SocketOptions) error {
+	if opts.ReadBuffer > 0 {
+		if err := conn.SetReadBuffer(opts.ReadBuffer); err != nil {
+			return err
+		}
+	}
+
+	if opts.WriteBuffer > 0 {
+		return conn.SetWriteBuffer(opts.WriteBuffer)
+	}
+
+	return nil
+}
+
+// ReadSocketOptions returns ReadBuffer and WriteBuffer of c as windows applied
+// them, the other options don't exist on windows.
+func ReadSocketOptions(c syscall.RawConn) (SocketOptions, error) {
+	var opts SocketOptions
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		for _, o := range []struct {
+			opt   int32
+			value *int
+		}{
+			{syscall.SO_RCVBUF, &opts.ReadBuffer},
+			{syscall.SO_SNDBUF, &opts.WriteBuffer},
+		} {
+			var v int32
+			l := int32(unsafe.Sizeof(v))
+			if err := syscall.Getsockopt(syscall.Handle(fd), syscall.SOL_SOCKET, o.opt, (*byte)(unsafe.Pointer(&v)), &l); err != nil {
+				sockErr = fmt.Errorf("getsockopt: %v", err)
+				return
+			}
+			*o.value = int(v)
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+
+	return opts, err
+}
@@ -0,0 +1,150 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// rawConn is the syscall.RawConn of a bare fd, e.g. given to
+// SocketOptions.Control before the socket is bound, so it can only be
+// controlled.
+type rawConn int
+
+// NewRawConn returns fd as a syscall.RawConn which only supports Control.
+func NewRawConn(fd int) syscall.RawConn {
+	return rawConn(fd)
+}
+
+func (fd rawConn) Control(f func(fd uintptr)) error {
+	f(uintptr(fd))
+	return nil
+}
+
+func (fd rawConn) Read(f func(fd uintptr) bool) error {
+	return errors.New("rawconn: read not supported")
+}
+
+func (fd rawConn) Write(f func(fd uintptr) bool) error {
+	return errors.New("rawconn: write not supported")
+}
+
+// sockopt is an int option read into value, or as a bool into flag.
+type sockopt struct {
+	level, opt int
+	value      *int
+	flag       *bool
+}
+
+// ReadSocketOptions returns the options of c as the kernel applied them, e.g.
+// with the capped and doubled buffer sizes. The IP level options are the IPv6
+// ones of an IPv6 socket, options the kernel doesn't know are left 0 and
+// Control is always nil.
+func ReadSocketOptions(c syscall.RawConn) (SocketOptions, error) {
+	var opts SocketOptions
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		opts, sockErr = readSocketOptions(int(fd))
+	})
+	if err == nil {
+		err = sockErr
+	}
+
+	return opts, err
+}
+
+func readSocketOptions(fd int) (SocketOptions, error) {
+	var opts SocketOptions
+	domain, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+	if err != nil {
+		return opts, os.NewSyscallError("getsockopt", err)
+	}
+
+	ipLevel, ip := unix.IPPROTO_IP, func(opt ipOption) int { return opt.v4 }
+	if domain == unix.AF_INET6 {
+		ipLevel, ip = unix.IPPROTO_IPV6, func(opt ipOption) int { return opt.v6 }
+	}
+
+	// pmtu stays -1 when the kernel doesn't know IP_MTU_DISCOVER.
+	busyPoll, pmtu := 0, -1
+	options := []sockopt{
+		{unix.SOL_SOCKET, unix.SO_REUSEPORT, nil, &opts.ReusePort},
+		{unix.SOL_SOCKET, unix.SO_RCVBUF, &opts.ReadBuffer, nil},
+		{unix.SOL_SOCKET, unix.SO_SNDBUF, &opts.WriteBuffer, nil},
+		{unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, nil, &opts.Timestamps},
+		{unix.SOL_SOCKET, unix.SO_RXQ_OVFL, nil, &opts.RecvDrops},
+		{unix.SOL_SOCKET, unix.SO_PRIORITY, &opts.Priority, nil},
+		{unix.SOL_SOCKET, unix.SO_MARK, &opts.Mark, nil},
+		{unix.SOL_SOCKET, unix.SO_BUSY_POLL, &busyPoll, nil},
+		{unix.IPPROTO_IP, unix.IP_FREEBIND, nil, &opts.FreeBind},
+		{ipLevel, ip(optTOS), &opts.TOS, nil},
+		{ipLevel, ip(optRecvTOS), nil, &opts.RecvTOS},
+		{ipLevel, ip(optTTL), &opts.TTL, nil},
+		{ipLevel, ip(optRecvTTL), nil, &opts.RecvTTL},
+		{ipLevel, ip(optRecvErr), nil, &opts.RecvErr},
+		{ipLevel, ip(optMTUDiscover), &pmtu, nil},
+	}
+
+	for _, o := range options {
+		v, err := unix.GetsockoptInt(fd, o.level, o.opt)
+		if errors.Is(err, unix.ENOPROTOOPT) {
+			continue
+		}
+
+		if err != nil {
+			return opts, os.NewSyscallError("getsockopt", err)
+		}
+
+		if o.value != nil {
+			*o.value = v
+		} else {
+			*o.flag = v != 0
+		}
+	}
+
+	if domain == unix.AF_INET6 {
+		v6only, err := unix.GetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY)
+		if err != nil {
+			return opts, os.NewSyscallError("getsockopt", err)
+		}
+
+		opts.V6Only = V6OnlyOff
+		if v6only != 0 {
+			opts.V6Only = V6OnlyOn
+		}
+	}
+
+	opts.BusyPoll = time.Duration(busyPoll) * time.Microsecond
+	opts.PMTUDiscovery = pmtuDiscoveryOf(pmtu)
+	if opts.BindToDevice, err = bindToDevice(fd); err != nil {
+		return opts, os.NewSyscallError("getsockopt", err)
+	}
+
+	return opts, nil
+}
+
+// bindToDevice reads SO_BINDTODEVICE, unix.GetsockoptString fails when the
+// socket isn't bound to a device because the kernel returns an empty value.
+func bindToDevice(fd int) (string, error) {
+	var name [unix.IFNAMSIZ]byte
+	l := uint32(len(name))
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE,
+		uintptr(unsafe.Pointer(&name[0])), uintptr(unsafe.Pointer(&l)), 0)
+	if errno != 0 {
+		return "", errno
+	}
+
+	if i := bytes.IndexByte(name[:l], 0); i >= 0 {
+		l = uint32(i)
+	}
+
+	return string(name[:l]), nil
+}
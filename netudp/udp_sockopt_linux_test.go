@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPMTUDiscoveryOf(t *testing.T) {
+	tests := []struct {
+		value int
+		want  PMTUDiscovery
+	}{
+		{unix.IP_PMTUDISC_DONT, PMTUDiscoveryDont},
+		{unix.IP_PMTUDISC_WANT, PMTUDiscoveryWant},
+		{unix.IP_PMTUDISC_DO, PMTUDiscoveryDo},
+		{unix.IP_PMTUDISC_PROBE, PMTUDiscoveryProbe},
+		{unix.IP_PMTUDISC_INTERFACE, PMTUDiscoveryDefault},
+		{unix.IP_PMTUDISC_OMIT, PMTUDiscoveryDefault},
+		// IP_MTU_DISCOVER couldn't be read
+		{-1, PMTUDiscoveryDefault},
+	}
+
+	for _, tt := range tests {
+		if got := pmtuDiscoveryOf(tt.value); got != tt.want {
+			t.Errorf("pmtuDiscoveryOf(%d) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	// pmtuDiscoveryOf is the inverse of pmtuDiscoveryValue
+	for _, mode := range []PMTUDiscovery{PMTUDiscoveryDont, PMTUDiscoveryWant, PMTUDiscoveryDo, PMTUDiscoveryProbe} {
+		v, err := pmtuDiscoveryValue(mode)
+		if err != nil {
+			t.Fatalf("pmtuDiscoveryValue(%v): %v", mode, err)
+		}
+
+		if got := pmtuDiscoveryOf(v); got != mode {
+			t.Errorf("pmtuDiscoveryOf(pmtuDiscoveryValue(%v)) = %v", mode, got)
+		}
+	}
+}
+
+func TestReadSocketOptions(t *testing.T) {
+	for _, tt := range []struct {
+		network, addr string
+	}{
+		{"udp4", "127.0.0.1:0"},
+		{"udp6", "[::1]:0"},
+	} {
+		t.Run(tt.network, func(t *testing.T) {
+			set := SocketOptions{
+				ReusePort:     true,
+				RecvTOS:       true,
+				RecvTTL:       true,
+				RecvErr:       true,
+				TTL:           9,
+				PMTUDiscovery: PMTUDiscoveryProbe,
+			}
+
+			fd, _, err := NewUDPSocket(tt.network, tt.addr, set)
+			if err != nil {
+				t.Skipf("NewUDPSocket: %v", err)
+			}
+			defer unix.Close(fd)
+
+			opts, err := ReadSocketOptions(NewRawConn(fd))
+			if err != nil {
+				t.Fatalf("ReadSocketOptions: %v", err)
+			}
+
+			if !opts.ReusePort || !opts.RecvTOS || !opts.RecvTTL || !opts.RecvErr {
+				t.Errorf("flags not read back: %+v", opts)
+			}
+
+			if opts.TTL != set.TTL || opts.PMTUDiscovery != set.PMTUDiscovery {
+				t.Errorf("TTL %d and PMTUDiscovery %v read back, want %d and %v", opts.TTL, opts.PMTUDiscovery, set.TTL, set.PMTUDiscovery)
+			}
+
+			if opts.ReadBuffer <= 0 || opts.WriteBuffer <= 0 {
+				t.Errorf("buffer sizes %d and %d read back", opts.ReadBuffer, opts.WriteBuffer)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package netudp
+
+import "fmt"
+
+// BPFInstruction is one instruction of a classic BPF program, it has the layout
+// of struct sock_filter.
+type BPFInstruction struct {
+	Op uint16
+	Jt uint8
+	Jf uint8
+	K  uint32
+}
+
+// classic BPF opcodes from include/uapi/linux/filter.h
+const (
+	bpfLD  = 0x00
+	bpfALU = 0x04
+	bpfRET = 0x06
+	bpfW   = 0x00
+	bpfH   = 0x08
+	bpfB   = 0x10
+	bpfABS = 0x20
+	bpfMOD = 0x90
+	bpfK   = 0x00
+	bpfA   = 0x10
+	// bpfMaxInstructions is BPF_MAXINSNS.
+	bpfMaxInstructions = 4096
+	// skfAdCPU is SKF_AD_OFF + SKF_AD_CPU, an absolute load from it reads the
+	// CPU which processes the packet.
+	skfAdCPU = 0xfffff000 + 36
+)
+
+// SteerByCPU returns a SO_REUSEPORT program which delivers the datagrams the CPU
+// c received to the socket c%n of the group.
+func SteerByCPU(n int) []BPFInstruction {
+	return []BPFInstruction{
+		{Op: bpfLD | bpfW | bpfABS, K: skfAdCPU},
+		{Op: bpfALU | bpfMOD | bpfK, K: uint32(n)},
+		{Op: bpfRET | bpfA},
+	}
+}
+
+// SteerByPayload returns a SO_REUSEPORT program which delivers a datagram to the
+// socket v%n of the group, v is the size bytes at offset of its payload in network
+// byte order, such as a connection ID. Datagrams too short to hold them go to the
+// first socket.
+func SteerByPayload(offset, size, n int) ([]BPFInstruction, error) {
+	var width uint16
+	switch size {
+	case 1:
+		width = bpfB
+	case 2:
+		width = bpfH
+	case 4:
+		width = bpfW
+	default:
+		return nil, fmt.Errorf("steering: payload size must be 1, 2 or 4, got %v", size)
+	}
+
+	if offset < 0 {
+		return nil, fmt.Errorf("steering: payload offset must not be negative, got %v", offset)
+	}
+
+	if n < 1 {
+		return nil, fmt.Errorf("steering: sockets must be at least 1, got %v", n)
+	}
+
+	return []BPFInstruction{
+		{Op: bpfLD | width | bpfABS, K: uint32(offset)},
+		{Op: bpfALU | bpfMOD | bpfK, K: uint32(n)},
+		{Op: bpfRET | bpfA},
+	}, nil
+}
@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// AttachReusePortProgram attaches prog with SO_ATTACH_REUSEPORT_CBPF to the
+// SO_REUSEPORT group of fd. prog runs on every datagram starting at its payload
+// and returns the index of the socket which receives it, the sockets are indexed
+// in the order they were bound. The kernel falls back to its hash when the index
+// is out of the group. Closing a socket moves the last one to its index.
+func AttachReusePortProgram(fd int, prog []BPFInstruction) error {
+	if len(prog) == 0 || len(prog) > bpfMaxInstructions {
+		return fmt.Errorf("steering: program must have [1, %v] instructions, got %v", bpfMaxInstructions, len(prog))
+	}
+
+	fprog := unix.SockFprog{
+		Len:    uint16(len(prog)),
+		Filter: (*unix.SockFilter)(unsafe.Pointer(&prog[0])),
+	}
+	return os.NewSyscallError("setsockopt", unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_REUSEPORT_CBPF, &fprog))
+}
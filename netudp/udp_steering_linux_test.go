@@ -0,0 +1,61 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import "testing"
+
+func TestAttachReusePortProgramLength(t *testing.T) {
+	rw, _ := newTestRW(t, "udp4", "127.0.0.1:0", SocketOptions{ReusePort: true})
+	for _, n := range []int{0, bpfMaxInstructions + 1} {
+		if err := AttachReusePortProgram(rw.fd, make([]BPFInstruction, n)); err == nil {
+			t.Errorf("AttachReusePortProgram() of %d instructions succeeded", n)
+		}
+	}
+}
+
+func TestSteerByPayloadLoopback(t *testing.T) {
+	opts := SocketOptions{ReusePort: true}
+	first, addr := newTestRW(t, "udp4", "127.0.0.1:0", opts)
+	second, _ := newTestRW(t, "udp4", addr.String(), opts)
+
+	prog, err := SteerByPayload(1, 1, 2)
+	if err != nil {
+		t.Fatalf("SteerByPayload: %v", err)
+	}
+
+	if err := AttachReusePortProgram(first.fd, prog); err != nil {
+		t.Skipf("SO_ATTACH_REUSEPORT_CBPF isn't supported: %v", err)
+	}
+
+	conn := listenTest(t, "udp4")
+	const n = 8
+	for i := 0; i < n; i++ {
+		if _, err := conn.WriteToUDPAddrPort([]byte{'x', byte(i)}, addr); err != nil {
+			t.Fatalf("WriteToUDPAddrPort: %v", err)
+		}
+	}
+
+	// a datagram too short for the program goes to the first socket
+	if _, err := conn.WriteToUDPAddrPort([]byte{'x'}, addr); err != nil {
+		t.Fatalf("WriteToUDPAddrPort: %v", err)
+	}
+
+	for i, rw := range []*ReaderWriter{first, second} {
+		want := n / 2
+		if i == 0 {
+			want++
+		}
+
+		got := readRW(t, rw, want)
+		if len(got) != want {
+			t.Fatalf("socket %d received %d datagrams, want %d", i, len(got), want)
+		}
+
+		for _, d := range got {
+			if len(d) > 1 && int(d[1])%2 != i {
+				t.Fatalf("socket %d received the datagram of %d", i, d[1])
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package netudp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSteerByPayload(t *testing.T) {
+	tests := []struct {
+		name         string
+		offset, size int
+		n            int
+		width        uint16
+		err          string
+	}{
+		{"byte", 0, 1, 4, bpfB, ""},
+		{"half word", 8, 2, 4, bpfH, ""},
+		{"word", 1, 4, 3, bpfW, ""},
+		{"size 0", 0, 0, 4, 0, "payload size"},
+		{"size 3", 0, 3, 4, 0, "payload size"},
+		{"size 8", 0, 8, 4, 0, "payload size"},
+		{"negative offset", -1, 2, 4, 0, "payload offset"},
+		{"no socket", 0, 2, 0, 0, "sockets"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := SteerByPayload(tt.offset, tt.size, tt.n)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("SteerByPayload() = %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("SteerByPayload() = %v", err)
+			}
+
+			want := []BPFInstruction{
+				{Op: bpfLD | tt.width | bpfABS, K: uint32(tt.offset)},
+				{Op: bpfALU | bpfMOD | bpfK, K: uint32(tt.n)},
+				{Op: bpfRET | bpfA},
+			}
+			if len(prog) != len(want) {
+				t.Fatalf("SteerByPayload() = %v, want %v", prog, want)
+			}
+
+			for i := range prog {
+				if prog[i] != want[i] {
+					t.Fatalf("SteerByPayload() = %v, want %v", prog, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSteerByCPU(t *testing.T) {
+	prog := SteerByCPU(6)
+	want := []BPFInstruction{
+		{Op: bpfLD | bpfW | bpfABS, K: skfAdCPU},
+		{Op: bpfALU | bpfMOD | bpfK, K: 6},
+		{Op: bpfRET | bpfA},
+	}
+
+	if len(prog) != len(want) {
+		t.Fatalf("SteerByCPU() = %v, want %v", prog, want)
+	}
+
+	for i := range prog {
+		if prog[i] != want[i] {
+			t.Fatalf("SteerByCPU() = %v, want %v", prog, want)
+		}
+	}
+}
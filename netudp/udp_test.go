@@ -0,0 +1,79 @@
+package netudp
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestAddrPortOf(t *testing.T) {
+	tests := []struct {
+		name string
+		addr *net.UDPAddr
+		want netip.AddrPort
+	}{
+		{"IPv4", &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 53}, netip.MustParseAddrPort("192.0.2.1:53")},
+		{"IPv4 in 16 bytes", &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53}, netip.MustParseAddrPort("192.0.2.1:53")},
+		{"IPv6", &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}, netip.MustParseAddrPort("[2001:db8::1]:53")},
+		{"IPv6 zone", &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 53, Zone: "eth0"}, netip.MustParseAddrPort("[fe80::1%eth0]:53")},
+		{"no IP", &net.UDPAddr{Port: 53}, netip.AddrPort{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// an address without IP is invalid whatever its port
+			got := AddrPortOf(tt.addr)
+			if got.IsValid() != tt.want.IsValid() || got.IsValid() && got != tt.want {
+				t.Fatalf("AddrPortOf(%v) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxPayload(t *testing.T) {
+	v4 := netip.MustParseAddrPort("192.0.2.1:53")
+	v6 := netip.MustParseAddrPort("[2001:db8::1]:53")
+	mapped := netip.MustParseAddrPort("[::ffff:192.0.2.1]:53")
+
+	tests := []struct {
+		name string
+		addr netip.AddrPort
+		mtu  int
+		want int
+	}{
+		{"IPv4", v4, 1500, 1472},
+		{"IPv6", v6, 1500, 1452},
+		{"IPv4-mapped", mapped, 1500, 1472},
+		{"IPv6 minimum MTU", v6, 1280, 1232},
+		{"IPv4 header only", v4, 28, 0},
+		{"IPv6 header only", v6, 48, 0},
+		{"unknown MTU", v4, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MaxPayload(tt.addr, tt.mtu); got != tt.want {
+				t.Fatalf("MaxPayload(%v, %d) = %d, want %d", tt.addr, tt.mtu, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmapAddrPort(t *testing.T) {
+	tests := []struct {
+		addr netip.AddrPort
+		want netip.AddrPort
+	}{
+		{netip.MustParseAddrPort("[::ffff:192.0.2.1]:53"), netip.MustParseAddrPort("192.0.2.1:53")},
+		{netip.MustParseAddrPort("192.0.2.1:53"), netip.MustParseAddrPort("192.0.2.1:53")},
+		{netip.MustParseAddrPort("[2001:db8::1]:53"), netip.MustParseAddrPort("[2001:db8::1]:53")},
+		{netip.MustParseAddrPort("[::]:53"), netip.MustParseAddrPort("[::]:53")},
+		{netip.AddrPort{}, netip.AddrPort{}},
+	}
+
+	for _, tt := range tests {
+		if got := UnmapAddrPort(tt.addr); got != tt.want {
+			t.Errorf("UnmapAddrPort(%v) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
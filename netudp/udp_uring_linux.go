@@ -0,0 +1,754 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The io_uring ABI, see include/uapi/linux/io_uring.h
+const (
+	ioringOpNop         = 0
+	ioringOpSendmsg     = 9
+	ioringOpRecvmsg     = 10
+	ioringOpAsyncCancel = 14
+
+	ioringSetupCQSize    = 1 << 3
+	ioringFeatSingleMmap = 1 << 0
+	ioringEnterGetEvents = 1 << 0
+
+	ioringRegisterPbufRing   = 22
+	ioringUnregisterPbufRing = 23
+
+	iosqeIOLink         = 1 << 2
+	iosqeBufferSelect   = 1 << 5
+	ioringRecvMultishot = 1 << 1
+
+	ioringCQEFBuffer     = 1 << 0
+	ioringCQEFMore       = 1 << 1
+	ioringCQEBufferShift = 16
+
+	ioringOffSQRing = 0
+	ioringOffSQEs   = 0x10000000
+
+	sizeofURingSQE = 64
+	sizeofURingCQE = 16
+	sizeofURingBuf = 16
+)
+
+// user_data of the requests of the receiving ring
+const (
+	uringRecv = iota + 1
+	uringWake
+	uringCancel
+)
+
+const (
+	// uringSendEntries bounds the sendmsg of a chain, longer batches are split
+	uringSendEntries = 64
+	// uringNamelen is the room of the name of a received datagram, it keeps
+	// the control which follows aligned
+	uringNamelen = (sizeofSockaddrInet6 + 7) &^ 7
+)
+
+type uringSQOffsets struct {
+	Head        uint32
+	Tail        uint32
+	RingMask    uint32
+	RingEntries uint32
+	Flags       uint32
+	Dropped     uint32
+	Array       uint32
+	Resv1       uint32
+	UserAddr    uint64
+}
+
+type uringCQOffsets struct {
+	Head        uint32
+	Tail        uint32
+	RingMask    uint32
+	RingEntries uint32
+	Overflow    uint32
+	CQEs        uint32
+	Flags       uint32
+	Resv1       uint32
+	UserAddr    uint64
+}
+
+type uringParams struct {
+	SQEntries    uint32
+	CQEntries    uint32
+	Flags        uint32
+	SQThreadCPU  uint32
+	SQThreadIdle uint32
+	Features     uint32
+	WQFd         uint32
+	Resv         [3]uint32
+	SQOff        uringSQOffsets
+	CQOff        uringCQOffsets
+}
+
+type uringSQE struct {
+	Opcode      uint8
+	Flags       uint8
+	IOPrio      uint16
+	Fd          int32
+	Off         uint64
+	Addr        uint64
+	Len         uint32
+	OpFlags     uint32
+	UserData    uint64
+	BufGroup    uint16
+	Personality uint16
+	SpliceFdIn  int32
+	Addr3       uint64
+	_           uint64
+}
+
+type uringCQE struct {
+	UserData uint64
+	Res      int32
+	Flags    uint32
+}
+
+// uringBuf is an entry of a provided buffer ring, the tail of the ring overlays
+// the Resv of its first entry.
+type uringBuf struct {
+	Addr uint64
+	Len  uint32
+	Bid  uint16
+	Resv uint16
+}
+
+type uringBufReg struct {
+	RingAddr    uint64
+	RingEntries uint32
+	Bgid        uint16
+	Flags       uint16
+	Resv        [3]uint64
+}
+
+// uringRecvmsgOut heads every buffer filled by a multishot recvmsg, the name,
+// the control and the payload follow, the first two with the room given by the
+// msghdr of the request.
+type uringRecvmsgOut struct {
+	Namelen    uint32
+	Controllen uint32
+	Payloadlen uint32
+	Flags      uint32
+}
+
+// errURingClosed reports a send on a ring which CloseURing released.
+var errURingClosed = errors.New("io_uring closed")
+
+var (
+	uringProbe   sync.Once
+	uringSupport bool
+	// uringRecvFlags are the flags of the multishot recvmsg, tests set an
+	// unknown one to fail it like a kernel without multishot recvmsg does
+	uringRecvFlags uint16 = ioringRecvMultishot
+)
+
+const sizeofURingRecvmsgOut = int(unsafe.Sizeof(uringRecvmsgOut{}))
+
+// uring is an io_uring instance whose rings are mapped.
+type uring struct {
+	fd      int
+	ring    []byte // the SQ and CQ rings, mapped at once
+	sqes    []byte
+	entries uint32
+	sqHead  *uint32
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray unsafe.Pointer
+	tail    uint32 // SQ tail, including the SQEs not submitted yet
+	cqHead  *uint32
+	cqTail  *uint32
+	cqMask  uint32
+	cqes    unsafe.Pointer
+}
+
+func newURing(entries, cqEntries uint32) (*uring, error) {
+	p := uringParams{Flags: ioringSetupCQSize, CQEntries: cqEntries}
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+
+	r := &uring{fd: int(fd), entries: p.SQEntries}
+	if p.Features&ioringFeatSingleMmap == 0 {
+		r.close()
+		return nil, fmt.Errorf("io_uring: rings can't be mapped at once")
+	}
+
+	size := p.SQOff.Array + p.SQEntries*4
+	if n := p.CQOff.CQEs + p.CQEntries*sizeofURingCQE; n > size {
+		size = n
+	}
+
+	var err error
+	r.ring, err = unix.Mmap(r.fd, ioringOffSQRing, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, os.NewSyscallError("mmap", err)
+	}
+
+	r.sqes, err = unix.Mmap(r.fd, ioringOffSQEs, int(p.SQEntries)*sizeofURingSQE, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, os.NewSyscallError("mmap", err)
+	}
+
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.ring[p.SQOff.Head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.ring[p.SQOff.Tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.ring[p.SQOff.RingMask]))
+	r.sqArray = unsafe.Pointer(&r.ring[p.SQOff.Array])
+	r.tail = *r.sqTail
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.ring[p.CQOff.Head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.ring[p.CQOff.Tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.ring[p.CQOff.RingMask]))
+	r.cqes = unsafe.Pointer(&r.ring[p.CQOff.CQEs])
+	return r, nil
+}
+
+// sqe returns a zeroed SQE queued for the next submit, the SQ must not be full.
+func (r *uring) sqe() *uringSQE {
+	i := r.tail & r.sqMask
+	sqe := (*uringSQE)(unsafe.Pointer(&r.sqes[i*sizeofURingSQE]))
+	*sqe = uringSQE{}
+	*(*uint32)(unsafe.Add(r.sqArray, i*4)) = i
+	r.tail++
+	return sqe
+}
+
+// enter submits the queued SQEs and waits until the CQ holds at least wait CQEs.
+func (r *uring) enter(wait uint32) error {
+	atomic.StoreUint32(r.sqTail, r.tail)
+	for {
+		var flags uintptr
+		if wait > 0 {
+			flags = ioringEnterGetEvents
+		}
+
+		submit := r.tail - atomic.LoadUint32(r.sqHead)
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(submit), uintptr(wait), flags, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+
+		if errno != 0 {
+			return os.NewSyscallError("io_uring_enter", errno)
+		}
+
+		return nil
+	}
+}
+
+// wait waits until the CQ holds at least n CQEs without submitting, it can be
+// called while another goroutine queues SQEs.
+func (r *uring) wait(n uint32) error {
+	_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), 0, uintptr(n), ioringEnterGetEvents, 0, 0)
+	if errno != 0 && errno != unix.EINTR {
+		return os.NewSyscallError("io_uring_enter", errno)
+	}
+
+	return nil
+}
+
+// peek calls f for every CQE available without consuming them.
+func (r *uring) peek(f func(cqe *uringCQE)) {
+	head := atomic.LoadUint32(r.cqHead)
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail; head++ {
+		f((*uringCQE)(unsafe.Add(r.cqes, (head&r.cqMask)*sizeofURingCQE)))
+	}
+}
+
+// reap calls f for every CQE available and consumes them.
+func (r *uring) reap(f func(cqe *uringCQE)) {
+	head := atomic.LoadUint32(r.cqHead)
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail; head++ {
+		f((*uringCQE)(unsafe.Add(r.cqes, (head&r.cqMask)*sizeofURingCQE)))
+	}
+
+	atomic.StoreUint32(r.cqHead, head)
+}
+
+// register calls io_uring_register with a single argument.
+func (r *uring) register(op uintptr, arg unsafe.Pointer) syscall.Errno {
+	_, _, errno := unix.Syscall6(unix.SYS_IO_URING_REGISTER, uintptr(r.fd), op, uintptr(arg), 1, 0, 0)
+	return errno
+}
+
+func (r *uring) close() {
+	if r.sqes != nil {
+		unix.Munmap(r.sqes)
+	}
+	if r.ring != nil {
+		unix.Munmap(r.ring)
+	}
+	unix.Close(r.fd)
+}
+
+// uringRW carries the reads and the batched writes of a ReaderWriter on
+// io_uring: a multishot recvmsg fills the buffers of a provided buffer ring and
+// a batch is sent as a chain of linked sendmsg.
+type uringRW struct {
+	recv    *uring
+	sqMu    sync.Mutex // guards the SQ of recv, WakeURing submits to it too
+	closed  bool       // guarded by sqMu and sendMu
+	stopped bool       // guarded by sqMu, the recvmsg isn't armed again
+	armed   bool       // a multishot recvmsg is pending
+	woken   bool       // readURing reaped the NOP of WakeURing, WaitURing returns at once
+	hdr     msghdr     // the room for the name and the control of a datagram
+	bufRing []byte
+	bufMask uint16
+	bufTail uint16
+	bufSize int
+	buffers []byte
+	send    *uring
+	sendMu  sync.Mutex
+	sendGen uint32 // tags the user_data of a chain, guarded by sendMu
+	results []int32
+}
+
+// EnableURing moves the reads and the batched writes of rw onto io_uring: a
+// multishot recvmsg receives into a ring of buffers without a syscall per batch
+// and WriteToN submits its messages as linked sendmsg. It must be called after
+// the other Enable methods and before the first read, reads are then driven by
+// WaitURing. It reports whether the kernel supports it, which needs provided
+// buffer rings and multishot recvmsg, rw keeps reading by recvmmsg otherwise.
+func (rw *ReaderWriter) EnableURing() bool {
+	if !uringSupported() {
+		return false
+	}
+
+	u, err := newURingRW(len(rw.msgs), rw.controlSpace, len(rw.buffers[0]))
+	if err != nil {
+		return false
+	}
+
+	// the recvmsg is armed here, a kernel without multishot recvmsg fails it
+	// as it's submitted
+	if err := u.arm(rw.fd); err != nil || u.armFailed() {
+		u.release()
+		return false
+	}
+
+	rw.ring = u
+	return true
+}
+
+// URing reports whether rw runs on io_uring.
+func (rw *ReaderWriter) URing() bool {
+	return rw.ring != nil
+}
+
+func newURingRW(n, controlSpace, payload int) (*uringRW, error) {
+	count := 1
+	for count < n {
+		count <<= 1
+	}
+
+	u := &uringRW{}
+	var err error
+	if u.recv, err = newURing(4, uint32(2*count+16)); err != nil {
+		return nil, err
+	}
+
+	if u.send, err = newURing(uringSendEntries, 2*uringSendEntries); err != nil {
+		u.recv.close()
+		return nil, err
+	}
+	u.results = make([]int32, u.send.entries)
+
+	u.hdr.Namelen = uringNamelen
+	u.hdr.Controllen = uint64(controlSpace)
+	u.bufSize = (sizeofURingRecvmsgOut + uringNamelen + controlSpace + payload + 7) &^ 7
+	u.buffers = make([]byte, count*u.bufSize)
+	u.bufMask = uint16(count - 1)
+	u.bufRing, err = unix.Mmap(-1, 0, count*sizeofURingBuf, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANONYMOUS|unix.MAP_PRIVATE)
+	if err != nil {
+		u.recv.close()
+		u.send.close()
+		return nil, os.NewSyscallError("mmap", err)
+	}
+
+	reg := uringBufReg{RingAddr: uint64(uintptr(unsafe.Pointer(&u.bufRing[0]))), RingEntries: uint32(count)}
+	if errno := u.recv.register(ioringRegisterPbufRing, unsafe.Pointer(&reg)); errno != 0 {
+		unix.Munmap(u.bufRing)
+		u.recv.close()
+		u.send.close()
+		return nil, os.NewSyscallError("io_uring_register", errno)
+	}
+
+	for bid := 0; bid < count; bid++ {
+		u.recycle(uint16(bid))
+	}
+	u.publish()
+	return u, nil
+}
+
+// buffer returns the buffer bid of the buffer ring.
+func (u *uringRW) buffer(bid uint16) []byte {
+	off := int(bid) * u.bufSize
+	return u.buffers[off : off+u.bufSize]
+}
+
+// recycle hands the buffer bid back to the kernel once published.
+func (u *uringRW) recycle(bid uint16) {
+	e := (*uringBuf)(unsafe.Pointer(&u.bufRing[int(u.bufTail&u.bufMask)*sizeofURingBuf]))
+	// Resv of the first entry is the tail, it's only written by publish
+	e.Addr = uint64(uintptr(unsafe.Pointer(&u.buffer(bid)[0])))
+	e.Len = uint32(u.bufSize)
+	e.Bid = bid
+	u.bufTail++
+}
+
+// publish makes the recycled buffers visible to the kernel.
+func (u *uringRW) publish() {
+	// the tail is stored along with the Bid of the first entry, which it follows
+	w := (*uint32)(unsafe.Pointer(&u.bufRing[12]))
+	bid := *(*uint16)(unsafe.Pointer(&u.bufRing[12]))
+	atomic.StoreUint32(w, uint32(bid)|uint32(u.bufTail)<<16)
+}
+
+// arm submits the multishot recvmsg, it stays pending until it fails or is
+// cancelled.
+func (u *uringRW) arm(fd int) error {
+	u.sqMu.Lock()
+	defer u.sqMu.Unlock()
+
+	if u.closed || u.stopped {
+		return nil
+	}
+
+	sqe := u.recv.sqe()
+	sqe.Opcode = ioringOpRecvmsg
+	sqe.Fd = int32(fd)
+	sqe.Addr = uint64(uintptr(unsafe.Pointer(&u.hdr)))
+	sqe.Len = 1
+	sqe.IOPrio = uringRecvFlags
+	sqe.Flags = iosqeBufferSelect
+	sqe.UserData = uringRecv
+	if err := u.recv.enter(0); err != nil {
+		return err
+	}
+
+	u.armed = true
+	return nil
+}
+
+// armFailed reports whether the kernel failed the recvmsg armed last with
+// EINVAL or EOPNOTSUPP, the CQEs are left to readURing.
+func (u *uringRW) armFailed() bool {
+	failed := false
+	u.recv.peek(func(cqe *uringCQE) {
+		if errno := syscall.Errno(-cqe.Res); cqe.UserData == uringRecv && (errno == unix.EINVAL || errno == unix.EOPNOTSUPP) {
+			failed = true
+		}
+	})
+	return failed
+}
+
+// readURing delivers the datagrams received by the ring so far.
+func (rw *ReaderWriter) readURing(readFunc func([]byte, netip.AddrPort, error)) int {
+	u := rw.ring
+	if !u.armed {
+		if err := u.arm(rw.fd); err != nil || u.armFailed() {
+			readFunc(nil, netip.AddrPort{}, err)
+			return 0
+		}
+	}
+
+	delivered := 0
+	recycled := false
+	u.recv.reap(func(cqe *uringCQE) {
+		if cqe.UserData == uringWake {
+			u.woken = true
+		}
+
+		if cqe.UserData != uringRecv {
+			return
+		}
+
+		// the recvmsg is over, it's armed again by the next read
+		if cqe.Flags&ioringCQEFMore == 0 {
+			u.armed = false
+		}
+
+		if cqe.Flags&ioringCQEFBuffer != 0 {
+			bid := uint16(cqe.Flags >> ioringCQEBufferShift)
+			if cqe.Res >= 0 {
+				delivered += rw.deliverURing(u.buffer(bid), readFunc)
+			}
+			u.recycle(bid)
+			recycled = true
+		}
+
+		// ENOBUFS when every buffer is in use, the datagrams wait in the socket
+		if errno := syscall.Errno(-cqe.Res); cqe.Res < 0 && errno != unix.ENOBUFS && errno != unix.ECANCELED {
+			readFunc(nil, netip.AddrPort{}, os.NewSyscallError("recvmsg", errno))
+		}
+	})
+
+	if recycled {
+		u.publish()
+	}
+
+	return delivered
+}
+
+// deliverURing calls readFunc for the datagrams of a buffer filled by recvmsg.
+func (rw *ReaderWriter) deliverURing(b []byte, readFunc func([]byte, netip.AddrPort, error)) int {
+	out := (*uringRecvmsgOut)(unsafe.Pointer(&b[0]))
+	name := sizeofURingRecvmsgOut
+	control := name + uringNamelen
+	payload := control + rw.controlSpace
+	addr, err := rw.sockaddrAddrPort(unsafe.Pointer(&b[name]))
+	if err != nil {
+		readFunc(nil, netip.AddrPort{}, err)
+		return 0
+	}
+
+	rw.parseControl(b[control:control+int(out.Controllen)], &rw.cm)
+	// Payloadlen is the length of a truncated datagram
+	data := b[payload:]
+	if int(out.Payloadlen) < len(data) {
+		data = data[:out.Payloadlen]
+	}
+
+	delivered := 0
+	for ; len(data) > 0; delivered++ {
+		rw.cur, data = rw.segment(data)
+		readFunc(rw.cur, addr, nil)
+	}
+
+	return delivered
+}
+
+// WaitURing blocks until the ring received datagrams or WakeURing is called,
+// it returns at once when the last read consumed a wake so that the caller
+// checks why it was woken.
+func (rw *ReaderWriter) WaitURing() error {
+	u := rw.ring
+	if u.woken {
+		u.woken = false
+		return nil
+	}
+
+	return u.recv.wait(1)
+}
+
+// WakeURing makes WaitURing return, it's safe to call from any goroutine.
+func (rw *ReaderWriter) WakeURing() error {
+	u := rw.ring
+	u.sqMu.Lock()
+	defer u.sqMu.Unlock()
+
+	if u.closed {
+		return nil
+	}
+
+	sqe := u.recv.sqe()
+	sqe.Opcode = ioringOpNop
+	sqe.UserData = uringWake
+	return u.recv.enter(0)
+}
+
+// StopURing cancels the multishot recvmsg and keeps it from being armed again,
+// the datagrams then wait in the socket as they do with epoll. The ones the ring
+// received before are still delivered. It's safe to call from any goroutine.
+func (rw *ReaderWriter) StopURing() error {
+	u := rw.ring
+	if u == nil {
+		return nil
+	}
+
+	u.sqMu.Lock()
+	defer u.sqMu.Unlock()
+
+	if u.closed || u.stopped {
+		return nil
+	}
+
+	u.stopped = true
+	sqe := u.recv.sqe()
+	sqe.Opcode = ioringOpAsyncCancel
+	sqe.Addr = uringRecv
+	sqe.UserData = uringCancel
+	return u.recv.enter(0)
+}
+
+// CloseURing releases the rings once the pending recvmsg is cancelled, writes
+// fall back to sendmmsg. It must be called after the last read.
+func (rw *ReaderWriter) CloseURing() {
+	u := rw.ring
+	if u == nil {
+		return
+	}
+
+	u.sendMu.Lock()
+	defer u.sendMu.Unlock()
+
+	u.sqMu.Lock()
+	u.closed = true
+	if u.armed {
+		sqe := u.recv.sqe()
+		sqe.Opcode = ioringOpAsyncCancel
+		sqe.Addr = uringRecv
+		sqe.UserData = uringCancel
+		if u.recv.enter(0) != nil {
+			u.armed = false
+		}
+	}
+	u.sqMu.Unlock()
+
+	// the kernel writes into the buffers until the recvmsg is over
+	for u.armed {
+		if u.recv.wait(1) != nil {
+			break
+		}
+
+		u.recv.reap(func(cqe *uringCQE) {
+			if cqe.UserData == uringRecv && cqe.Flags&ioringCQEFMore == 0 {
+				u.armed = false
+			}
+		})
+	}
+
+	u.release()
+}
+
+// release unregisters the buffer ring and closes the rings, the kernel must be
+// done with the buffers.
+func (u *uringRW) release() {
+	reg := uringBufReg{}
+	u.recv.register(ioringUnregisterPbufRing, unsafe.Pointer(&reg))
+	unix.Munmap(u.bufRing)
+	u.recv.close()
+	u.send.close()
+}
+
+// sendmsg sends mms as chains of linked sendmsg, a chain is cut at the first
+// failure so that, like sendmmsg, the messages sent are a prefix of mms.
+func (u *uringRW) sendmsg(fd int, mms []mmsghdr, flags int) (int, error) {
+	u.sendMu.Lock()
+	defer u.sendMu.Unlock()
+
+	if u.closed {
+		return 0, errURingClosed
+	}
+
+	r := u.send
+	sent := 0
+	for sent < len(mms) {
+		n := len(mms) - sent
+		if n > int(r.entries) {
+			n = int(r.entries)
+		}
+
+		// the generation in the upper half of user_data tells the CQEs of this
+		// chain from the ones of a chain which failed to be waited for
+		u.sendGen++
+		gen := uint64(u.sendGen) << 32
+		head := atomic.LoadUint32(r.sqHead)
+		for i := 0; i < n; i++ {
+			sqe := r.sqe()
+			sqe.Opcode = ioringOpSendmsg
+			sqe.Fd = int32(fd)
+			sqe.Addr = uint64(uintptr(unsafe.Pointer(&mms[sent+i].Hdr)))
+			sqe.Len = 1
+			// a busy socket fails the request instead of waiting for it
+			sqe.OpFlags = uint32(flags | unix.MSG_DONTWAIT)
+			sqe.UserData = gen | uint64(i)
+			if i < n-1 {
+				sqe.Flags = iosqeIOLink
+			}
+		}
+
+		if err := r.enter(uint32(n)); err != nil {
+			u.drain(gen, head)
+			return sent, err
+		}
+
+		r.reap(func(cqe *uringCQE) {
+			if cqe.UserData&^0xffffffff == gen {
+				if i := int(uint32(cqe.UserData)); i < n {
+					u.results[i] = cqe.Res
+				}
+			}
+		})
+
+		for i := 0; i < n; i++ {
+			if res := u.results[i]; res < 0 {
+				// the requests linked after a failed one are cancelled
+				return sent, os.NewSyscallError("sendmsg", syscall.Errno(-res))
+			}
+			sent++
+		}
+	}
+
+	return sent, nil
+}
+
+// drain drops the SQEs of the chain gen the kernel didn't take, then waits for
+// the ones it took from head on, they refer to the messages of the caller. The
+// CQEs of the chain are consumed so the next chain doesn't read them.
+func (u *uringRW) drain(gen uint64, head uint32) {
+	r := u.send
+	r.tail = atomic.LoadUint32(r.sqHead)
+	atomic.StoreUint32(r.sqTail, r.tail)
+	for pending := int(r.tail - head); pending > 0; {
+		if err := r.wait(1); err != nil {
+			return
+		}
+
+		r.reap(func(cqe *uringCQE) {
+			if cqe.UserData&^0xffffffff == gen {
+				pending--
+			}
+		})
+	}
+}
+
+// uringSupported reports whether the kernel registers provided buffer rings,
+// kernels which don't know the registration fail it with EINVAL, the other
+// failures are left to newURingRW. It's probed once. Multishot recvmsg came
+// later, EnableURing checks it on the socket.
+func uringSupported() bool {
+	uringProbe.Do(func() {
+		r, err := newURing(1, 2)
+		if err != nil {
+			return
+		}
+		defer r.close()
+
+		ring, err := unix.Mmap(-1, 0, sizeofURingBuf, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANONYMOUS|unix.MAP_PRIVATE)
+		if err != nil {
+			return
+		}
+		defer unix.Munmap(ring)
+
+		reg := uringBufReg{RingAddr: uint64(uintptr(unsafe.Pointer(&ring[0]))), RingEntries: 1}
+		errno := r.register(ioringRegisterPbufRing, unsafe.Pointer(&reg))
+		if errno == 0 {
+			reg = uringBufReg{}
+			r.register(ioringUnregisterPbufRing, unsafe.Pointer(&reg))
+		}
+		uringSupport = errno != unix.EINVAL
+	})
+
+	return uringSupport
+}
@@ -0,0 +1,168 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// newTestURing returns a ReaderWriter of a loopback socket read through
+// io_uring, the test is skipped when the kernel doesn't support it.
+func newTestURing(t *testing.T) (*ReaderWriter, netip.AddrPort) {
+	t.Helper()
+	rw, addr := newTestRW(t, "udp4", "127.0.0.1:0", SocketOptions{})
+	if !rw.EnableURing() {
+		t.Skip("io_uring isn't supported")
+	}
+
+	// cleanups run last in first, the rings are released before the socket is closed
+	t.Cleanup(rw.CloseURing)
+	return rw, addr
+}
+
+// readURing reads datagrams from rw until n arrived or none came for a while.
+func readURing(t *testing.T, rw *ReaderWriter, n int) [][]byte {
+	t.Helper()
+	var datagrams [][]byte
+	readFunc := func(data []byte, addr netip.AddrPort, err error) {
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		datagrams = append(datagrams, append([]byte(nil), data...))
+	}
+
+	for idle := 0; len(datagrams) < n && idle < 100; idle++ {
+		if rw.ReadFromAddrPort(readFunc) > 0 {
+			idle = 0
+			continue
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return datagrams
+}
+
+func TestURingReadWrite(t *testing.T) {
+	rw, addr := newTestURing(t)
+	conn := listenTest(t, "udp4")
+	peer := AddrPortOf(conn.LocalAddr().(*net.UDPAddr))
+
+	const n = 32
+	for i := 0; i < n; i++ {
+		if _, err := conn.WriteToUDPAddrPort([]byte{byte(i)}, addr); err != nil {
+			t.Fatalf("WriteToUDPAddrPort: %v", err)
+		}
+	}
+
+	got := readURing(t, rw, n)
+	if len(got) != n {
+		t.Fatalf("received %d datagrams, want %d", len(got), n)
+	}
+
+	// a batch is sent as linked sendmsg
+	mmsgs := testMmsgs(peer, 100, 200, 300)
+	if sent, err := rw.WriteToN(mmsgs...); err != nil || sent != len(mmsgs) {
+		t.Fatalf("WriteToN() = %d, %v, want %d", sent, err, len(mmsgs))
+	}
+
+	replies := readTest(t, conn, len(mmsgs))
+	if len(replies) != len(mmsgs) {
+		t.Fatalf("peer received %d datagrams, want %d", len(replies), len(mmsgs))
+	}
+
+	for i, d := range replies {
+		if len(d) != len(mmsgs[i].Data) {
+			t.Fatalf("datagram %d has %d bytes, want %d", i, len(d), len(mmsgs[i].Data))
+		}
+	}
+}
+
+func TestURingWakeNotLost(t *testing.T) {
+	rw, _ := newTestURing(t)
+	noop := func([]byte, netip.AddrPort, error) {}
+	rw.ReadFromAddrPort(noop)
+
+	// the wake is reaped by a read before the reader waits
+	if err := rw.WakeURing(); err != nil {
+		t.Fatalf("WakeURing: %v", err)
+	}
+	rw.ReadFromAddrPort(noop)
+
+	done := make(chan error, 1)
+	go func() { done <- rw.WaitURing() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("WaitURing: %v", err)
+		}
+	case <-time.After(time.Second):
+		rw.WakeURing()
+		<-done
+		t.Fatal("WaitURing blocked on a wake consumed by the last read")
+	}
+}
+
+func TestURingStop(t *testing.T) {
+	rw, addr := newTestURing(t)
+	conn := listenTest(t, "udp4")
+	if _, err := conn.WriteToUDPAddrPort([]byte("before"), addr); err != nil {
+		t.Fatalf("WriteToUDPAddrPort: %v", err)
+	}
+
+	if got := readURing(t, rw, 1); len(got) != 1 {
+		t.Fatalf("received %d datagrams, want 1", len(got))
+	}
+
+	if err := rw.StopURing(); err != nil {
+		t.Fatalf("StopURing: %v", err)
+	}
+
+	// the recvmsg is over once the cancellation is reaped
+	readURing(t, rw, 1)
+	if _, err := conn.WriteToUDPAddrPort([]byte("after"), addr); err != nil {
+		t.Fatalf("WriteToUDPAddrPort: %v", err)
+	}
+
+	if got := readURing(t, rw, 1); len(got) != 0 {
+		t.Fatalf("received %q after StopURing", got)
+	}
+
+	// the datagram waits in the socket
+	buf := make([]byte, 16)
+	fds := []unix.PollFd{{Fd: int32(rw.fd), Events: unix.POLLIN}}
+	unix.Poll(fds, 1000)
+	n, _, err := unix.Recvfrom(rw.fd, buf, unix.MSG_DONTWAIT)
+	if err != nil || string(buf[:n]) != "after" {
+		t.Fatalf("socket holds %q, %v, want %q", buf[:n], err, "after")
+	}
+}
+
+func TestURingFallback(t *testing.T) {
+	if !uringSupported() {
+		t.Skip("io_uring isn't supported")
+	}
+
+	// an unknown flag is refused like multishot recvmsg is by kernels before 6.0
+	uringRecvFlags = 1 << 15
+	defer func() { uringRecvFlags = ioringRecvMultishot }()
+
+	rw, addr := newTestRW(t, "udp4", "127.0.0.1:0", SocketOptions{})
+	if rw.EnableURing() || rw.URing() {
+		t.Fatal("EnableURing() succeeded with a failing recvmsg")
+	}
+
+	conn := listenTest(t, "udp4")
+	if _, err := conn.WriteToUDPAddrPort([]byte("ping"), addr); err != nil {
+		t.Fatalf("WriteToUDPAddrPort: %v", err)
+	}
+
+	if got := readRW(t, rw, 1); len(got) != 1 || string(got[0]) != "ping" {
+		t.Fatalf("received %q by recvmmsg, want %q", got, "ping")
+	}
+}
@@ -0,0 +1,82 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import (
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// zeroCopy tracks the MSG_ZEROCOPY sends of a socket until the kernel reports
+// their completion on the error queue. The kernel numbers every send from 0,
+// a completion covers a range of these ids.
+type zeroCopy struct {
+	sync.Mutex // held across the sends so that their ids follow the kernel counter
+	next       uint32
+	pending    []zeroCopySend
+	// done holds the callbacks of a completion, it's only used by ReadErrQueue
+	done []func()
+}
+
+type zeroCopySend struct {
+	id   uint32
+	done func()
+}
+
+// EnableZeroCopy sets SO_ZEROCOPY, the datagrams with a Done callback are then
+// sent with MSG_ZEROCOPY by WriteMsg and WriteToN. Their pages stay pinned
+// until the completion is read by ReadErrQueue, which calls Done. It must be
+// called before the first write and reports whether the kernel supports it.
+func (rw *ReaderWriter) EnableZeroCopy() bool {
+	if err := unix.SetsockoptInt(rw.fd, unix.SOL_SOCKET, unix.SO_ZEROCOPY, 1); err != nil {
+		return false
+	}
+
+	rw.zc = &zeroCopy{}
+	return true
+}
+
+// ZeroCopy reports whether zero-copy sends are enabled.
+func (rw *ReaderWriter) ZeroCopy() bool {
+	return rw.zc != nil
+}
+
+// zeroCopied reports whether msg is sent with MSG_ZEROCOPY.
+func (rw *ReaderWriter) zeroCopied(msg *Mmsg) bool {
+	return rw.zc != nil && msg.Done != nil
+}
+
+// add registers done for the send id, zc must be locked.
+func (zc *zeroCopy) add(id uint32, done func()) {
+	zc.pending = append(zc.pending, zeroCopySend{id: id, done: done})
+}
+
+// complete calls the callbacks of the sends lo to hi, the range may wrap.
+func (zc *zeroCopy) complete(lo, hi uint32) {
+	zc.Lock()
+	i := 0
+	for i < len(zc.pending) && zc.pending[i].id-lo > hi-lo {
+		i++
+	}
+
+	j := i
+	for j < len(zc.pending) && zc.pending[j].id-lo <= hi-lo {
+		zc.done = append(zc.done, zc.pending[j].done)
+		j++
+	}
+
+	n := copy(zc.pending[i:], zc.pending[j:])
+	for k := i + n; k < len(zc.pending); k++ {
+		zc.pending[k] = zeroCopySend{}
+	}
+	zc.pending = zc.pending[:i+n]
+	zc.Unlock()
+
+	for k, done := range zc.done {
+		done()
+		zc.done[k] = nil
+	}
+	zc.done = zc.done[:0]
+}
@@ -0,0 +1,113 @@
+//go:build linux
+// +build linux
+
+package netudp
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestZeroCopyComplete(t *testing.T) {
+	tests := []struct {
+		name    string
+		pending []uint32
+		lo, hi  uint32
+		done    []uint32
+		left    []uint32
+	}{
+		{"one", []uint32{0, 1, 2}, 0, 0, []uint32{0}, []uint32{1, 2}},
+		{"range", []uint32{0, 1, 2, 3}, 0, 2, []uint32{0, 1, 2}, []uint32{3}},
+		{"all", []uint32{5, 6}, 5, 6, []uint32{5, 6}, nil},
+		{"middle", []uint32{1, 2, 3}, 2, 2, []uint32{2}, []uint32{1, 3}},
+		{"covers more", []uint32{4, 5}, 0, 9, []uint32{4, 5}, nil},
+		{"none", []uint32{4, 5}, 6, 7, nil, []uint32{4, 5}},
+		{"wraps", []uint32{0xfffffffe, 0xffffffff, 0, 1}, 0xfffffffe, 0, []uint32{0xfffffffe, 0xffffffff, 0}, []uint32{1}},
+		{"after the wrap", []uint32{0xffffffff, 0, 1}, 0, 1, []uint32{0, 1}, []uint32{0xffffffff}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zc := &zeroCopy{}
+			var done []uint32
+			for _, id := range tt.pending {
+				id := id
+				zc.add(id, func() { done = append(done, id) })
+			}
+
+			zc.complete(tt.lo, tt.hi)
+			if !equalIDs(done, tt.done) {
+				t.Fatalf("complete(%#x, %#x) called %v, want %v", tt.lo, tt.hi, done, tt.done)
+			}
+
+			var left []uint32
+			for _, s := range zc.pending {
+				left = append(left, s.id)
+			}
+			if !equalIDs(left, tt.left) {
+				t.Fatalf("complete(%#x, %#x) left %v, want %v", tt.lo, tt.hi, left, tt.left)
+			}
+
+			if len(zc.done) != 0 {
+				t.Fatalf("%d callbacks kept after complete", len(zc.done))
+			}
+		})
+	}
+}
+
+func equalIDs(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestZeroCopyLoopback(t *testing.T) {
+	rw, _ := newTestRW(t, "udp4", "127.0.0.1:0", SocketOptions{})
+	if !rw.EnableZeroCopy() {
+		t.Skip("SO_ZEROCOPY isn't supported")
+	}
+
+	conn := listenTest(t, "udp4")
+	peer := AddrPortOf(conn.LocalAddr().(*net.UDPAddr))
+
+	const n = 3
+	var done []int
+	for i := 0; i < n; i++ {
+		i := i
+		msg := &Mmsg{Addr: peer, Data: make([]byte, 1000), Done: func() { done = append(done, i) }}
+		if err := rw.WriteMsg(msg); err != nil {
+			t.Fatalf("WriteMsg: %v", err)
+		}
+	}
+
+	// the completions are queued on the error queue, they aren't PeerErrors
+	for len(done) < n {
+		fds := []unix.PollFd{{Fd: int32(rw.fd), Events: unix.POLLIN}}
+		if m, _ := unix.Poll(fds, 2000); m == 0 {
+			t.Fatalf("%d of %d sends completed", len(done), n)
+		}
+
+		if _, err := rw.ReadErrQueue(func(e *PeerError) { t.Fatalf("unexpected error: %v", e) }); err != nil {
+			t.Fatalf("ReadErrQueue: %v", err)
+		}
+	}
+
+	for i, id := range done {
+		if id != i {
+			t.Fatalf("completed %v, want the sends in order", done)
+		}
+	}
+
+	if got := readTest(t, conn, n); len(got) != n {
+		t.Fatalf("received %d datagrams, want %d", len(got), n)
+	}
+}
@@ -0,0 +1,107 @@
+package fastudp
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/shaoyuan1943/fastudp/netudp"
+)
+
+// Packet is a datagram delivered to a PacketEventHandler. Its data aliases the
+// read buffer of the event-loop and is only valid until OnPacket returns, unless
+// the packet is retained: Retain moves the buffer out of the read batch without
+// copying it (a pooled buffer takes its slot), so the packet can be handed to
+// another goroutine. Every Retain must be paired with a Release.
+type Packet struct {
+	data  []byte
+	buf   []byte // owned buffer once retained, data aliases it
+	addr  netip.AddrPort
+	ln    *Listener
+	cm    netudp.ControlMessage
+	refs  int32
+	owner packetOwner
+}
+
+type packetOwner interface {
+	// detach takes a buffer holding the data of p at its start out of the read batch.
+	detach(p *Packet) []byte
+	// recycle is called when the last reference of p is released.
+	recycle(p *Packet)
+}
+
+func (p *Packet) Data() []byte {
+	return p.data
+}
+
+func (p *Packet) Addr() netip.AddrPort {
+	return p.addr
+}
+
+// Listener returns the listener whose socket received p.
+func (p *Packet) Listener() *Listener {
+	return p.ln
+}
+
+// LocalAddr returns the local address p was sent to, it's only valid with
+// Config.PacketInfo and useful for a listener bound to a wildcard address.
+func (p *Packet) LocalAddr() netip.Addr {
+	return p.cm.Dst
+}
+
+// IfIndex returns the index of the interface p arrived on, 0 without Config.PacketInfo.
+func (p *Packet) IfIndex() int {
+	return p.cm.IfIndex
+}
+
+// Timestamp returns the time the kernel received p, it's only set with
+// Config.Socket.Timestamps.
+func (p *Packet) Timestamp() time.Time {
+	return p.cm.Timestamp
+}
+
+// TOS returns the TOS byte or IPv6 traffic class of p, its ECN bits are TOS&0x3.
+// It's only set with Config.Socket.RecvTOS.
+func (p *Packet) TOS() int {
+	return p.cm.TOS
+}
+
+// TTL returns the TTL or hop limit of p, it's only set with Config.Socket.RecvTTL.
+func (p *Packet) TTL() int {
+	return p.cm.TTL
+}
+
+// Retain takes a reference of p which keeps its data valid until the matching
+// Release. The first Retain must be called from inside OnPacket.
+func (p *Packet) Retain() {
+	if p.buf == nil {
+		p.own()
+	}
+
+	atomic.AddInt32(&p.refs, 1)
+}
+
+// Release drops a reference of p, p and its data must not be used afterwards.
+func (p *Packet) Release() {
+	refs := atomic.AddInt32(&p.refs, -1)
+	if refs == 0 {
+		p.owner.recycle(p)
+	} else if refs < 0 {
+		panic("fastudp: Packet released more often than retained")
+	}
+}
+
+// own moves the data of p into a buffer owned by p.
+func (p *Packet) own() {
+	p.buf = p.owner.detach(p)
+	p.data = p.buf[:len(p.data)]
+}
+
+func (p *Packet) reset() {
+	p.data = nil
+	p.buf = nil
+	p.addr = netip.AddrPort{}
+	p.ln = nil
+	p.cm = netudp.ControlMessage{}
+	p.refs = 0
+}
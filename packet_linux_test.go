@@ -0,0 +1,269 @@
+//go:build linux
+// +build linux
+
+package fastudp
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// packetInfo is what OnPacket saw of a packet.
+type packetInfo struct {
+	data      string
+	addr      netip.AddrPort
+	local     netip.Addr
+	ifIndex   int
+	timestamp time.Time
+	tos       int
+	ttl       int
+}
+
+// packetHandler reports every packet, it replies from the local address of the
+// packet when reply is set.
+type packetHandler struct {
+	packets chan packetInfo
+	reply   bool
+}
+
+func newPacketHandler(reply bool) *packetHandler {
+	return &packetHandler{packets: make(chan packetInfo, 16), reply: reply}
+}
+
+func (h *packetHandler) OnReaded([]byte, *net.UDPAddr) {}
+func (h *packetHandler) OnError(err error)             {}
+
+func (h *packetHandler) OnPacket(p *Packet, w Writer) {
+	h.packets <- packetInfo{
+		data:      string(p.Data()),
+		addr:      p.Addr(),
+		local:     p.LocalAddr(),
+		ifIndex:   p.IfIndex(),
+		timestamp: p.Timestamp(),
+		tos:       p.TOS(),
+		ttl:       p.TTL(),
+	}
+
+	if h.reply {
+		w.WriteMsgTo(p.Data(), p.Addr(), p.LocalAddr(), p.IfIndex())
+	}
+}
+
+// nextPacket returns the next packet h reported.
+func (h *packetHandler) nextPacket(t *testing.T) packetInfo {
+	t.Helper()
+	select {
+	case info := <-h.packets:
+		return info
+	case <-time.After(2 * time.Second):
+		t.Fatal("no packet was delivered")
+	}
+
+	return packetInfo{}
+}
+
+// loopbackIndex returns the index of the loopback interface.
+func loopbackIndex(t *testing.T) int {
+	t.Helper()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("Interfaces: %v", err)
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface.Index
+		}
+	}
+
+	t.Skip("no loopback interface")
+	return 0
+}
+
+// loopback returns the loopback address of network, the test is skipped when
+// the network isn't available.
+func loopback(t *testing.T, network string) string {
+	t.Helper()
+	addr := "127.0.0.1:0"
+	if network == "udp6" {
+		addr = "[::1]:0"
+	}
+
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		t.Skipf("listen %v: %v", network, err)
+	}
+	conn.Close()
+	return addr
+}
+
+// sendTo sends msg from svr to the first listener of dst, through the write
+// queue of an event-loop when queued is set.
+func sendTo(t *testing.T, svr, dst *Server, msg Message, queued bool) {
+	t.Helper()
+	msg.AddrPort = dst.Listeners()[0].Addr()
+	if !queued {
+		if _, err := svr.WriteMsg(&msg); err != nil {
+			t.Fatalf("WriteMsg: %v", err)
+		}
+		return
+	}
+
+	loop := testLoops(svr)[0]
+	loop.Lock()
+	defer loop.Unlock()
+	if err := loop.push(msg.mmsg()); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+}
+
+func TestPacketInfo(t *testing.T) {
+	config := DefaultConfig()
+	config.PacketInfo = true
+	h := newPacketHandler(true)
+	svr := startServerOn(t, "udp4", "0.0.0.0:0", h, config)
+	port := svr.Listeners()[0].Addr().Port()
+	lo := loopbackIndex(t)
+	peer := listenPeer(t)
+
+	// the listener is bound to the wildcard address, the replies leave from the
+	// address every request was sent to
+	for _, dst := range []string{"127.0.0.1", "127.0.0.2"} {
+		t.Run(dst, func(t *testing.T) {
+			to := netip.AddrPortFrom(netip.MustParseAddr(dst), port)
+			if _, err := peer.WriteToUDPAddrPort([]byte("ping"), to); err != nil {
+				t.Fatalf("WriteToUDPAddrPort: %v", err)
+			}
+
+			info := h.nextPacket(t)
+			if info.local != to.Addr() || info.ifIndex != lo {
+				t.Fatalf("packet to %v on %d, want %v on %d", info.local, info.ifIndex, to.Addr(), lo)
+			}
+
+			buf := make([]byte, 16)
+			peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, from, err := peer.ReadFromUDPAddrPort(buf)
+			if err != nil || string(buf[:n]) != "ping" {
+				t.Fatalf("reply %q, %v, want %q", buf[:n], err, "ping")
+			}
+
+			if from != to {
+				t.Fatalf("reply from %v, want %v", from, to)
+			}
+		})
+	}
+}
+
+func TestPacketTimestamp(t *testing.T) {
+	tests := []struct {
+		name       string
+		timestamps bool
+	}{
+		{"disabled", false},
+		{"enabled", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.Socket.Timestamps = tt.timestamps
+			h := newPacketHandler(false)
+			svr := startServer(t, h, config)
+			conn := dialServer(t, svr)
+
+			before := time.Now()
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+
+			ts := h.nextPacket(t).timestamp
+			if !tt.timestamps {
+				if !ts.IsZero() {
+					t.Fatalf("Timestamp() = %v without Timestamps", ts)
+				}
+				return
+			}
+
+			// the kernel stamps the datagram between the write and its delivery
+			if ts.Before(before.Add(-time.Millisecond)) || ts.After(time.Now()) {
+				t.Fatalf("Timestamp() = %v, want between %v and now", ts, before)
+			}
+		})
+	}
+}
+
+func TestPacketTOS(t *testing.T) {
+	tests := []struct {
+		name      string
+		socketTOS int
+		msgTOS    int
+		queued    bool
+		want      int
+	}{
+		{"kernel default", 0, 0, false, 0},
+		{"socket", 0x10, 0, false, 0x10},
+		{"message", 0x10, 0x28, false, 0x28},
+		{"ECN", 0, 0x01, false, 0x01},
+		{"queued message", 0x10, 0x28, true, 0x28},
+	}
+
+	for _, network := range []string{"udp4", "udp6"} {
+		for _, tt := range tests {
+			t.Run(network+"/"+tt.name, func(t *testing.T) {
+				addr := loopback(t, network)
+				config := DefaultConfig()
+				config.Socket.TOS = tt.socketTOS
+				sender := startServerOn(t, network, addr, newPacketHandler(false), config)
+
+				config = DefaultConfig()
+				config.Socket.RecvTOS = true
+				h := newPacketHandler(false)
+				receiver := startServerOn(t, network, addr, h, config)
+
+				sendTo(t, sender, receiver, Message{Data: []byte("ping"), TOS: tt.msgTOS}, tt.queued)
+				if tos := h.nextPacket(t).tos; tos != tt.want {
+					t.Fatalf("TOS() = %#x, want %#x", tos, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestPacketTTL(t *testing.T) {
+	tests := []struct {
+		name      string
+		socketTTL int
+		msgTTL    int
+		queued    bool
+		want      int // 0 for the default of the kernel
+	}{
+		{"kernel default", 0, 0, false, 0},
+		{"socket", 10, 0, false, 10},
+		{"message", 10, 5, false, 5},
+		{"queued message", 10, 3, true, 3},
+	}
+
+	for _, network := range []string{"udp4", "udp6"} {
+		for _, tt := range tests {
+			t.Run(network+"/"+tt.name, func(t *testing.T) {
+				addr := loopback(t, network)
+				config := DefaultConfig()
+				config.Socket.TTL = tt.socketTTL
+				sender := startServerOn(t, network, addr, newPacketHandler(false), config)
+
+				config = DefaultConfig()
+				config.Socket.RecvTTL = true
+				h := newPacketHandler(false)
+				receiver := startServerOn(t, network, addr, h, config)
+
+				sendTo(t, sender, receiver, Message{Data: []byte("ping"), TTL: tt.msgTTL}, tt.queued)
+				ttl := h.nextPacket(t).ttl
+				if tt.want == 0 && ttl <= 0 || tt.want != 0 && ttl != tt.want {
+					t.Fatalf("TTL() = %d, want %d", ttl, tt.want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package fastudp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// testOwner hands out copies of a read buffer and records recycled packets.
+type testOwner struct {
+	read     []byte
+	detached int
+	recycled []*Packet
+}
+
+func (o *testOwner) detach(p *Packet) []byte {
+	o.detached++
+	buf := make([]byte, len(o.read))
+	copy(buf, o.read)
+	return buf
+}
+
+func (o *testOwner) recycle(p *Packet) {
+	o.recycled = append(o.recycled, p)
+	p.reset()
+}
+
+func newTestPacket(o *testOwner, data string) *Packet {
+	o.read = []byte(data)
+	return &Packet{data: o.read, owner: o, refs: 1}
+}
+
+func TestPacketRetainRelease(t *testing.T) {
+	tests := []struct {
+		name    string
+		retains int
+	}{
+		{"not retained", 0},
+		{"retained once", 1},
+		{"retained twice", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &testOwner{}
+			p := newTestPacket(o, "payload")
+			for i := 0; i < tt.retains; i++ {
+				p.Retain()
+			}
+
+			want := 0
+			if tt.retains > 0 {
+				want = 1
+			}
+
+			if o.detached != want {
+				t.Fatalf("detached %d times, want %d", o.detached, want)
+			}
+
+			// the read buffer is reused by the next batch
+			copy(o.read, "XXXXXXX")
+			if tt.retains > 0 && string(p.Data()) != "payload" {
+				t.Fatalf("data of a retained packet = %q, want %q", p.Data(), "payload")
+			}
+
+			// the read callback releases its own reference
+			for i := 0; i <= tt.retains; i++ {
+				if len(o.recycled) != 0 {
+					t.Fatalf("recycled with %d references left", tt.retains+1-i)
+				}
+				p.Release()
+			}
+
+			if len(o.recycled) != 1 || o.recycled[0] != p {
+				t.Fatalf("recycled %d packets, want p once", len(o.recycled))
+			}
+
+			if p.Data() != nil || p.refs != 0 {
+				t.Fatalf("recycled packet wasn't reset: data %q, refs %d", p.Data(), p.refs)
+			}
+		})
+	}
+}
+
+func TestPacketReleaseTooOften(t *testing.T) {
+	p := newTestPacket(&testOwner{}, "payload")
+	p.Release()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("a Release without a reference didn't panic")
+		}
+	}()
+	p.Release()
+}
+
+// retainHandler retains every Packet and hands it to packets.
+type retainHandler struct {
+	packets chan *Packet
+}
+
+func (h *retainHandler) OnReaded([]byte, *net.UDPAddr) {}
+func (h *retainHandler) OnError(err error)             {}
+
+func (h *retainHandler) OnPacket(p *Packet, w Writer) {
+	p.Retain()
+	h.packets <- p
+}
+
+func TestPacketRetainedAcrossReads(t *testing.T) {
+	const n = 64
+	config := DefaultConfig()
+	config.ReadBatchSize = 4
+	h := &retainHandler{packets: make(chan *Packet, n)}
+	svr := startServer(t, h, config)
+	conn := dialServer(t, svr)
+
+	for i := 0; i < n; i++ {
+		if _, err := conn.Write(bytes.Repeat([]byte{byte(i)}, 100)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < n; i++ {
+		select {
+		case p := <-h.packets:
+			if want := bytes.Repeat([]byte{byte(i)}, 100); !bytes.Equal(p.Data(), want) {
+				t.Fatalf("datagram %d was overwritten by a later read", i)
+			}
+			p.Release()
+		case <-timeout:
+			t.Fatalf("got %d of %d datagrams", i, n)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package fastudp
+
+import "net/netip"
+
+// peerHash is FNV-1a over address and port, the zone is ignored.
+func peerHash(addr netip.AddrPort) uint32 {
+	h := uint32(2166136261)
+	for _, b := range addr.Addr().As16() {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+
+	port := addr.Port()
+	h ^= uint32(port >> 8)
+	h *= 16777619
+	h ^= uint32(port & 0xff)
+	h *= 16777619
+	return h
+}
@@ -0,0 +1,46 @@
+package fastudp
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPeerHash(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  string
+		equal bool
+	}{
+		{"same", "10.0.0.1:53", "10.0.0.1:53", true},
+		{"IPv4-mapped", "10.0.0.1:53", "[::ffff:10.0.0.1]:53", true},
+		{"zone", "[fe80::1%eth0]:53", "[fe80::1%eth1]:53", true},
+		{"port", "10.0.0.1:53", "10.0.0.1:54", false},
+		{"port bytes swapped", "10.0.0.1:258", "10.0.0.1:513", false},
+		{"address", "10.0.0.1:53", "10.0.0.2:53", false},
+		{"family", "[::1]:53", "[::ffff:0.0.0.1]:53", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := netip.MustParseAddrPort(tt.a), netip.MustParseAddrPort(tt.b)
+			if equal := peerHash(a) == peerHash(b); equal != tt.equal {
+				t.Fatalf("peerHash(%v) == peerHash(%v) is %v, want %v", a, b, equal, tt.equal)
+			}
+		})
+	}
+}
+
+func TestPeerHashSpread(t *testing.T) {
+	const loops, peers = 4, 4096
+	var counts [loops]int
+	for i := 0; i < peers; i++ {
+		addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 4242)
+		counts[peerHash(addr)%loops]++
+	}
+
+	for i, n := range counts {
+		if n < peers/loops/2 || n > peers/loops*2 {
+			t.Errorf("event-loop %d got %d of %d peers", i, n, peers)
+		}
+	}
+}
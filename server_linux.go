@@ -4,135 +4,559 @@
 package fastudp
 
 import (
+	"context"
 	"fmt"
 	"net"
-	"runtime"
+	"net/netip"
+	"sort"
 	"sync"
 	"sync/atomic"
 
+	"golang.org/x/sys/unix"
+
 	"github.com/shaoyuan1943/fastudp/netpoll"
 	"github.com/shaoyuan1943/fastudp/netudp"
 )
 
 type Server struct {
+	drops      uint64 // atomic, first for its alignment
 	wg         sync.WaitGroup
 	handler    EventHandler
+	handlers   *handlers
+	dispatcher *dispatcher // nil for DispatchInline
 	loops      map[int]*eventLoop
-	wp         chan []byte
-	pool       sync.Pool
+	listeners  atomic.Value // []*Listener, replaced as a whole under the lock
 	closed     atomic.Value
-	lockThread bool
+	config     Config
+	done       chan struct{} // closed when the last event-loop has exited
+	err        error         // first error which closed an event-loop
 	sync.Mutex
 }
 
-func NewUDPServer(network, addr string, reusePort bool, listenerN int, mtu int, handler EventHandler, enableLockThread bool) (*Server, error) {
+// NewUDPServer listens on addr and serves it with config.ListenerN event-loops,
+// a zero Config selects all defaults. More addresses can be served by the same
+// server with AddListener.
+func NewUDPServer(network, addr string, handler EventHandler, config Config) (*Server, error) {
+	svr, err := newServer(handler, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := svr.AddListener(network, addr); err != nil {
+		svr.Shutdown(context.Background())
+		return nil, err
+	}
+
+	return svr, nil
+}
+
+func newServer(handler EventHandler, config Config) (*Server, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	svr := &Server{
+		handler: handler,
+		loops:   make(map[int]*eventLoop),
+		config:  config,
+		done:    make(chan struct{}),
+	}
+	svr.handlers = newHandlers(handler)
+	if svr.config.Dispatch.Mode != DispatchInline {
+		svr.dispatcher = newDispatcher(svr.handlers, &svr.config.Dispatch)
+	}
+
+	svr.listeners.Store([]*Listener(nil))
+	svr.closed.Store(false)
+	return svr, nil
+}
+
+// AddListener listens on addr with Config.ListenerN event-loops of its own, it
+// can be called while the server is running. With port 0 all the sockets of the
+// listener share the port picked by the kernel for the first one.
+func (svr *Server) AddListener(network, addr string) (*Listener, error) {
 	if !netudp.IsUDP(network) {
 		return nil, fmt.Errorf("unknown network: %v", network)
 	}
 
-	svr := &Server{
-		handler:    handler,
-		loops:      make(map[int]*eventLoop),
-		wp:         make(chan []byte, WriteEventSize),
-		lockThread: enableLockThread,
+	ln := newListener(svr, network)
+	socks := make([]*socket, 0, svr.config.ListenerN)
+	closeSocks := func() {
+		for _, sock := range socks {
+			unix.Close(sock.fd)
+		}
 	}
 
-	svr.pool.New = func() interface{} {
-		return make([]byte, mtu)
+	for i := 0; i < svr.config.ListenerN; i++ {
+		sock, err := listen(network, addr, svr.config.Socket)
+		if err != nil {
+			closeSocks()
+			return nil, err
+		}
+
+		if i == 0 {
+			ln.addr = sock.local
+			ln.opts = sock.opts
+			addr = sock.local.String()
+		}
+		socks = append(socks, sock)
+	}
+
+	// the group is complete, the index of every socket is the one of its
+	// event-loop, the program is attached before any of them serves
+	prog, err := svr.config.Steering.program(svr.config.ListenerN)
+	if err == nil && prog != nil {
+		err = netudp.AttachReusePortProgram(socks[0].fd, prog)
 	}
 
-	if reusePort {
-		if listenerN <= 0 {
-			listenerN = runtime.NumCPU()
+	if err != nil {
+		closeSocks()
+		return nil, err
+	}
+
+	for i, sock := range socks {
+		if _, err = svr.serve(ln, sock, svr.config.cpu(i)); err != nil {
+			socks = socks[i+1:]
+			closeSocks()
+			break
 		}
-	} else {
-		listenerN = 1
 	}
 
-	if err := svr.start(network, addr, reusePort, listenerN, mtu); err != nil {
+	if err == nil {
+		err = svr.addListener(ln)
+	}
+
+	if err != nil {
+		svr.stopListener(context.Background(), ln)
 		return nil, err
 	}
 
-	svr.closed.Store(false)
-	return svr, nil
+	return ln, nil
 }
 
-func (s *Server) start(network, addr string, reusePort bool, listenerN, mtu int) error {
-	for i := 0; i < listenerN; i++ {
-		l, err := listen(network, addr, reusePort)
-		if err != nil {
-			return err
+// RemoveListener stops ln the way Shutdown stops the server: reading stops, the
+// queued datagrams are flushed until they are all sent or ctx is done, then the
+// event-loops of ln are closed and waited for. Other listeners keep running.
+func (svr *Server) RemoveListener(ctx context.Context, ln *Listener) error {
+	if ln == nil || ln.svr != svr {
+		return fmt.Errorf("listener not found")
+	}
+
+	svr.Lock()
+	svr.removeListener(ln)
+	svr.Unlock()
+
+	return svr.stopListener(ctx, ln)
+}
+
+// Listeners returns the listeners of the server in the order they were added.
+func (svr *Server) Listeners() []*Listener {
+	listeners := svr.listeners.Load().([]*Listener)
+	return append([]*Listener(nil), listeners...)
+}
+
+func (svr *Server) addListener(ln *Listener) error {
+	svr.Lock()
+	defer svr.Unlock()
+
+	if svr.closed.Load().(bool) {
+		return fmt.Errorf("server closed")
+	}
+
+	if ln.removed.Load().(bool) {
+		return fmt.Errorf("listener closed")
+	}
+
+	listeners := svr.listeners.Load().([]*Listener)
+	svr.listeners.Store(append(listeners[:len(listeners):len(listeners)], ln))
+	return nil
+}
+
+// removeListener must be called with the lock held.
+func (svr *Server) removeListener(ln *Listener) {
+	ln.removed.Store(true)
+
+	listeners := svr.listeners.Load().([]*Listener)
+	for i, l := range listeners {
+		if l == ln {
+			rest := make([]*Listener, 0, len(listeners)-1)
+			rest = append(rest, listeners[:i]...)
+			svr.listeners.Store(append(rest, listeners[i+1:]...))
+			return
 		}
+	}
+}
 
-		poller, err := netpoll.PollerInit()
-		if err != nil {
-			return err
+func (svr *Server) stopListener(ctx context.Context, ln *Listener) error {
+	svr.Lock()
+	var loops []*eventLoop
+	for _, loop := range svr.loops {
+		if loop.ln == ln {
+			loops = append(loops, loop)
 		}
+	}
+	svr.Unlock()
 
-		loop := newEventLoop(s, l, poller, mtu)
-		s.loops[loop.l.fd] = loop
-		poller.Add(loop.l.fd, "r")
+	closeLoops(ctx, loops)
+
+	waitC := make(chan struct{})
+	go func() {
+		ln.wg.Wait()
+		close(waitC)
+	}()
+
+	select {
+	case <-waitC:
+	case <-ctx.Done():
+	}
 
-		go loop.run(s.lockThread)
+	return ctx.Err()
+}
+
+// serve starts an event-loop of ln for sock pinned to cpu unless it's -1, sock
+// is closed when it fails.
+func (s *Server) serve(ln *Listener, sock *socket, cpu int) (*eventLoop, error) {
+	if cpu >= 0 {
+		if err := pinSocket(sock.fd, cpu); err != nil {
+			unix.Close(sock.fd)
+			return nil, err
+		}
+	}
+
+	poller, err := netpoll.PollerInit()
+	if err != nil {
+		unix.Close(sock.fd)
+		return nil, err
+	}
+
+	loop := newEventLoop(s, ln, sock, poller)
+	loop.cpu = cpu
+	s.Lock()
+	if s.closed.Load().(bool) {
+		s.Unlock()
+		loop.rw.CloseURing()
+		poller.Close()
+		unix.Close(sock.fd)
+		return nil, fmt.Errorf("server closed")
+	}
+
+	s.loops[loop.sock.fd] = loop
+	s.wg.Add(1)
+	ln.wg.Add(1)
+	s.Unlock()
+	ln.lb.register(loop)
+	poller.Add(loop.sock.fd, loop.pollMode(false))
+
+	go loop.run()
+	if loop.rw.URing() {
+		go loop.ringLoop()
+	} else {
 		go loop.readLoop()
+	}
+	return loop, nil
+}
 
-		s.wg.Add(1)
+// closeLoops stops reading on loops, flushes their queued datagrams until they
+// are all sent or ctx is done, then closes them.
+func closeLoops(ctx context.Context, loops []*eventLoop) {
+	for _, loop := range loops {
+		loop.stopRead()
 	}
 
-	return nil
+	var wg sync.WaitGroup
+	for _, loop := range loops {
+		wg.Add(1)
+		go func(loop *eventLoop) {
+			defer wg.Done()
+			loop.drain(ctx)
+		}(loop)
+	}
+	wg.Wait()
+
+	for _, loop := range loops {
+		loop.Close(nil)
+	}
 }
 
-func (svr *Server) Shutdown() {
-	if svr.closed.Load().(bool) {
-		return
+// Shutdown stops reading on every event-loop, flushes the queued datagrams until
+// they are all sent or ctx is done, then closes the event-loops and waits for them.
+// It returns ctx.Err() when ctx is done first, unsent datagrams are dropped.
+func (svr *Server) Shutdown(ctx context.Context) error {
+	svr.Lock()
+	if !svr.closed.CompareAndSwap(false, true) {
+		svr.Unlock()
+		return nil
+	}
+
+	loops := make([]*eventLoop, 0, len(svr.loops))
+	for _, loop := range svr.loops {
+		loops = append(loops, loop)
+	}
+	svr.Unlock()
+
+	closeLoops(ctx, loops)
+
+	waitC := make(chan struct{})
+	go func() {
+		svr.wg.Wait()
+		// no event-loop dispatches anymore, let the workers finish
+		if svr.dispatcher != nil {
+			svr.dispatcher.close()
+		}
+		close(waitC)
+	}()
+
+	select {
+	case <-waitC:
+	case <-ctx.Done():
+	}
+
+	return ctx.Err()
+}
+
+// Stats returns a snapshot of the server counters.
+func (svr *Server) Stats() Stats {
+	stats := Stats{Drops: atomic.LoadUint64(&svr.drops)}
+	if svr.dispatcher != nil {
+		stats.Dispatch = svr.dispatcher.stats()
 	}
 
-	loops := make(map[int]*eventLoop)
 	svr.Lock()
-	for fd, loop := range svr.loops {
-		loops[fd] = loop
+	loops := make([]*eventLoop, 0, len(svr.loops))
+	for _, loop := range svr.loops {
+		loops = append(loops, loop)
 	}
 	svr.Unlock()
 
+	sort.Slice(loops, func(i, j int) bool { return loops[i].sock.fd < loops[j].sock.fd })
 	for _, loop := range loops {
-		if !loop.closed.Load().(bool) {
-			loop.Close(nil)
-		}
+		stats.Loops = append(stats.Loops, LoopStats{
+			Addr:   loop.ln.addr,
+			Drops:  atomic.LoadUint64(&loop.drops),
+			Queued: loop.queueLen(),
+		})
 	}
 
-	svr.wg.Wait()
-	svr.closed.Store(true)
+	return stats
+}
+
+// PathMTU returns the MTU the kernel knows for the path to addr from a socket with
+// Config.Socket, see netudp.PathMTU. netudp.MaxPayload turns it into the largest
+// datagram which isn't fragmented.
+func (svr *Server) PathMTU(addr netip.AddrPort) (int, error) {
+	return netudp.PathMTU(addr, svr.config.Socket)
+}
+
+// Serve blocks until ctx is done or every event-loop has exited, then shuts the
+// server down within Config.ShutdownTimeout. It returns the error which closed
+// the event-loops, or the shutdown error.
+func (svr *Server) Serve(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+	case <-svr.done:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), svr.config.ShutdownTimeout)
+	defer cancel()
+
+	err := svr.Shutdown(shutdownCtx)
+
+	svr.Lock()
+	defer svr.Unlock()
+	if svr.err != nil {
+		return svr.err
+	}
+
+	return err
 }
 
 func (svr *Server) eventLoopClosed(loop *eventLoop, err error) {
 	svr.Lock()
 	defer svr.Unlock()
 
-	delete(svr.loops, loop.l.fd)
+	delete(svr.loops, loop.sock.fd)
+	loop.ln.lb.unregister(loop)
+	if loop.ln.lb.len() == 0 {
+		svr.removeListener(loop.ln)
+	}
+	loop.ln.wg.Done()
 	svr.wg.Done()
 
+	// removing the last listener doesn't stop the server, failing does
+	if len(svr.loops) == 0 && (err != nil || svr.closed.Load().(bool)) {
+		select {
+		case <-svr.done:
+		default:
+			close(svr.done)
+		}
+	}
+
 	if err != nil {
+		if svr.err == nil {
+			svr.err = err
+		}
+
 		svr.handler.OnError(err)
 	}
 }
 
-// TODO: need load balancing?
+// next picks the event-loop which last received from addr on any listener, or
+// else the one picked by Config.LoadBalancing on the first listener.
+func (svr *Server) next(addr netip.AddrPort) *eventLoop {
+	listeners := svr.listeners.Load().([]*Listener)
+	for _, ln := range listeners {
+		if loop := ln.lb.lookup(addr); loop != nil {
+			return loop
+		}
+	}
+
+	for _, ln := range listeners {
+		if loop := ln.lb.next(addr); loop != nil {
+			return loop
+		}
+	}
+
+	return nil
+}
+
+// WriteTo sends data to addr through the event-loop which last received from
+// addr, or else through the first listener. Listener.WriteTo picks the source.
 func (svr *Server) WriteTo(data []byte, addr *net.UDPAddr) (int, error) {
+	if addr == nil {
+		return 0, fmt.Errorf("writeto: addr invalid")
+	}
+
+	return svr.WriteToAddrPort(data, netudp.AddrPortOf(addr))
+}
+
+// WriteToAddrPort is WriteTo with a netip.AddrPort, it doesn't allocate.
+func (svr *Server) WriteToAddrPort(data []byte, addr netip.AddrPort) (int, error) {
+	loop, err := svr.pick(nil, addr)
+	if err != nil {
+		return 0, err
+	}
+
+	return loop.WriteToAddrPort(data, addr)
+}
+
+// WriteMsgTo works like Writer.WriteMsgTo through the event-loop picked like WriteTo.
+func (svr *Server) WriteMsgTo(data []byte, addr netip.AddrPort, src netip.Addr, ifIndex int) (int, error) {
+	loop, err := svr.pick(nil, addr)
+	if err != nil {
+		return 0, err
+	}
+
+	return loop.WriteMsgTo(data, addr, src, ifIndex)
+}
+
+// WriteMsg works like Writer.WriteMsg through the event-loop picked like WriteTo.
+func (svr *Server) WriteMsg(msg *Message) (int, error) {
+	loop, err := svr.pick(nil, msg.addrPort())
+	if err != nil {
+		return 0, err
+	}
+
+	return loop.WriteMsg(msg)
+}
+
+// WriteBatch sends msgs through the event-loops picked like WriteTo,
+// messages for the same event-loop keep their order and share sendmmsg calls.
+// The result of every message is reported in its Status and Err, it returns
+// the number of messages sent or queued and the first error.
+func (svr *Server) WriteBatch(msgs []Message) (int, error) {
+	if err := svr.writable(nil); err != nil {
+		return 0, err
+	}
+
+	return writeBatch(msgs, svr.next)
+}
+
+// writable reports why svr, or ln unless it's nil, doesn't take writes anymore.
+func (svr *Server) writable(ln *Listener) error {
 	if svr.closed.Load().(bool) {
-		return 0, fmt.Errorf("server closed")
+		return fmt.Errorf("server closed")
+	}
+
+	if ln != nil && ln.removed.Load().(bool) {
+		return fmt.Errorf("listener removed")
+	}
+
+	return nil
+}
+
+// pick returns the event-loop a write to addr goes through: the one picked by
+// Config.LoadBalancing among the ones of ln, or by next when ln is nil.
+func (svr *Server) pick(ln *Listener, addr netip.AddrPort) (*eventLoop, error) {
+	if err := svr.writable(ln); err != nil {
+		return nil, err
 	}
 
 	var loop *eventLoop
-	svr.Lock()
-	for _, l := range svr.loops {
-		loop = l
-		break
+	if ln != nil {
+		loop = ln.lb.next(addr)
+	} else {
+		loop = svr.next(addr)
 	}
-	svr.Unlock()
 
 	if loop == nil {
-		return 0, fmt.Errorf("not found valid event-loop")
+		return nil, fmt.Errorf("not found valid event-loop")
+	}
+
+	return loop, nil
+}
+
+func writeBatch(msgs []Message, next func(netip.AddrPort) *eventLoop) (int, error) {
+	var firstErr error
+	var order []*eventLoop
+	groups := make(map[*eventLoop][]int)
+	for i := range msgs {
+		var loop *eventLoop
+		addr := msgs[i].addrPort()
+		if addr.IsValid() {
+			loop = next(addr)
+		}
+
+		if loop == nil {
+			err := fmt.Errorf("not found valid event-loop")
+			if !addr.IsValid() {
+				err = fmt.Errorf("writebatch: addr invalid")
+			}
+
+			msgs[i].fail(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		if _, ok := groups[loop]; !ok {
+			order = append(order, loop)
+		}
+		groups[loop] = append(groups[loop], i)
+	}
+
+	if len(order) == 1 && len(groups[order[0]]) == len(msgs) {
+		return order[0].WriteBatch(msgs)
+	}
+
+	accepted := 0
+	for _, loop := range order {
+		indexes := groups[loop]
+		group := make([]Message, len(indexes))
+		for j, i := range indexes {
+			group[j] = msgs[i]
+		}
+
+		n, err := loop.WriteBatch(group)
+		accepted += n
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		for j, i := range indexes {
+			msgs[i] = group[j]
+		}
 	}
 
-	return loop.writeTo(data, addr)
+	return accepted, firstErr
 }
@@ -0,0 +1,268 @@
+//go:build linux
+// +build linux
+
+package fastudp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/shaoyuan1943/fastudp/netudp"
+)
+
+// testLoops returns the event-loops of svr.
+func testLoops(svr *Server) []*eventLoop {
+	svr.Lock()
+	defer svr.Unlock()
+
+	loops := make([]*eventLoop, 0, len(svr.loops))
+	for _, loop := range svr.loops {
+		loops = append(loops, loop)
+	}
+	return loops
+}
+
+func TestServerShutdownFlushesQueue(t *testing.T) {
+	config := DefaultConfig()
+	config.ListenerN = 1
+	svr := startServer(t, newEchoHandler(), config)
+	peer := listenPeer(t)
+	addr := peer.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	// datagrams left in the write queue when Shutdown is called
+	loop := testLoops(svr)[0]
+	want := []string{"a", "b", "c"}
+	loop.Lock()
+	for _, data := range want {
+		if err := loop.push(netudp.Mmsg{Addr: addr, Data: []byte(data)}); err != nil {
+			t.Fatalf("push: %v", err)
+		}
+	}
+	loop.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := svr.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	got := readPeer(t, peer, len(want))
+	if len(got) != len(want) {
+		t.Fatalf("peer received %q, want %q", got, want)
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("peer received %q, want %q", got, want)
+		}
+	}
+}
+
+func TestServerShutdownWhileWriting(t *testing.T) {
+	config := DefaultConfig()
+	config.ListenerN = 2
+	config.Socket.ReusePort = true
+	svr := startServer(t, newEchoHandler(), config)
+	peer := listenPeer(t)
+	addr := peer.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	// the writes racing the shutdown fail without reaching the closed fds
+	errC := make(chan error, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(errC); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if _, err := svr.WriteToAddrPort([]byte("data"), addr); err != nil {
+					errC <- err
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := svr.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	wg.Wait()
+	close(errC)
+	for err := range errC {
+		if isSyscallError(err) {
+			t.Fatalf("write during Shutdown: %v", err)
+		}
+	}
+}
+
+func TestServerWriteToAddrPortAllocs(t *testing.T) {
+	config := DefaultConfig()
+	config.ListenerN = 1
+	svr := startServer(t, newEchoHandler(), config)
+	peer := listenPeer(t)
+	addr := peer.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	data := []byte("data")
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := svr.WriteToAddrPort(data, addr); err != nil {
+			t.Fatalf("WriteToAddrPort: %v", err)
+		}
+	})
+
+	if allocs != 0 {
+		t.Fatalf("WriteToAddrPort allocates %v times, want 0", allocs)
+	}
+}
+
+func TestServerPathMTU(t *testing.T) {
+	config := DefaultConfig()
+	config.ListenerN = 1
+	config.Socket.PMTUDiscovery = netudp.PMTUDiscoveryDo
+	svr := startServer(t, newEchoHandler(), config)
+	peer := listenPeer(t)
+	addr := peer.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	if got := svr.Listeners()[0].SocketOptions().PMTUDiscovery; got != netudp.PMTUDiscoveryDo {
+		t.Fatalf("listener PMTUDiscovery %v, want %v", got, netudp.PMTUDiscoveryDo)
+	}
+
+	// the MTU of the loopback interface, no ICMP lowered it
+	mtu, err := svr.PathMTU(addr)
+	if err != nil {
+		t.Fatalf("PathMTU: %v", err)
+	}
+
+	if mtu <= 0 || netudp.MaxPayload(addr, mtu) < config.MTU {
+		t.Fatalf("PathMTU() = %d, want room for a datagram of %d", mtu, config.MTU)
+	}
+
+	if _, err := svr.PathMTU(netip.AddrPort{}); err == nil {
+		t.Fatalf("PathMTU of an invalid addr succeeded")
+	}
+}
+
+func TestServerWriteTooLong(t *testing.T) {
+	config := DefaultConfig()
+	config.ListenerN = 1
+	svr := startServer(t, newEchoHandler(), config)
+	peer := listenPeer(t)
+	addr := peer.LocalAddr().(*net.UDPAddr).AddrPort()
+	data := make([]byte, config.MTU+1)
+
+	tests := []struct {
+		name  string
+		write func() error
+	}{
+		{"WriteToAddrPort", func() error {
+			_, err := svr.WriteToAddrPort(data, addr)
+			return err
+		}},
+		{"WriteMsg", func() error {
+			_, err := svr.WriteMsg(&Message{AddrPort: addr, Data: data})
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the caller re-segments as for a path MTU exceeded
+			var pe *netudp.PeerError
+			if err := tt.write(); !errors.As(err, &pe) || pe.Err != unix.EMSGSIZE || pe.Addr != addr {
+				t.Fatalf("write of %d bytes: %v, want an EMSGSIZE PeerError", len(data), err)
+			}
+		})
+	}
+
+	// a datagram of the MTU still goes out
+	if _, err := svr.WriteToAddrPort(data[:config.MTU], addr); err != nil {
+		t.Fatalf("WriteToAddrPort of %d bytes: %v", config.MTU, err)
+	}
+
+	if got := readPeer(t, peer, 1); len(got) != 1 || len(got[0]) != config.MTU {
+		t.Fatalf("peer received %d datagrams, want 1 of %d bytes", len(got), config.MTU)
+	}
+}
+
+func TestServerDualStack(t *testing.T) {
+	loopback(t, "udp6")
+	tests := []struct {
+		network string
+		dst     string
+	}{
+		{"udp4", "127.0.0.1"},
+		{"udp6", "::1"},
+	}
+
+	config := DefaultConfig()
+	config.PacketInfo = true
+	h := newPacketHandler(true)
+	svr := startServerOn(t, "udp", ":0", h, config)
+	ln := svr.Listeners()[0]
+	if got := ln.SocketOptions().V6Only; got != netudp.V6OnlyOff {
+		t.Fatalf("V6Only %v, want %v", got, netudp.V6OnlyOff)
+	}
+
+	// IPv4 peers and local addresses are reported unmapped, the replies leave
+	// from the address every request was sent to
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			to := netip.AddrPortFrom(netip.MustParseAddr(tt.dst), ln.Addr().Port())
+			conn, err := net.DialUDP(tt.network, nil, net.UDPAddrFromAddrPort(to))
+			if err != nil {
+				t.Fatalf("DialUDP: %v", err)
+			}
+			defer conn.Close()
+
+			if got := roundTrip(t, conn, []byte("ping")); string(got) != "ping" {
+				t.Fatalf("reply %q, want %q", got, "ping")
+			}
+
+			info := h.nextPacket(t)
+			if info.addr != conn.LocalAddr().(*net.UDPAddr).AddrPort() || info.local != to.Addr() {
+				t.Fatalf("packet from %v to %v, want from %v to %v", info.addr, info.local, conn.LocalAddr(), to.Addr())
+			}
+		})
+	}
+}
+
+func TestServerV6Only(t *testing.T) {
+	loopback(t, "udp6")
+	config := DefaultConfig()
+	config.Socket.V6Only = netudp.V6OnlyOn
+	h := newPacketHandler(false)
+	svr := startServerOn(t, "udp", ":0", h, config)
+	ln := svr.Listeners()[0]
+	if got := ln.SocketOptions().V6Only; got != netudp.V6OnlyOn {
+		t.Fatalf("V6Only %v, want %v", got, netudp.V6OnlyOn)
+	}
+
+	// the IPv4 datagram finds no socket, the IPv6 one behind it is read first
+	peer := listenPeer(t)
+	if _, err := peer.WriteToUDPAddrPort([]byte("v4"), netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), ln.Addr().Port())); err != nil {
+		t.Fatalf("WriteToUDPAddrPort: %v", err)
+	}
+
+	conn, err := net.DialUDP("udp6", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.IPv6Loopback(), ln.Addr().Port())))
+	if err != nil {
+		t.Fatalf("DialUDP: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("v6")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if info := h.nextPacket(t); info.data != "v6" {
+		t.Fatalf("packet %q read, want %q", info.data, "v6")
+	}
+}
@@ -0,0 +1,355 @@
+package fastudp
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// echoHandler sends every datagram back to its peer through the Writer of the
+// event-loop which read it.
+type echoHandler struct {
+	errC chan error
+}
+
+func newEchoHandler() *echoHandler {
+	return &echoHandler{errC: make(chan error, 16)}
+}
+
+func (h *echoHandler) OnReaded([]byte, *net.UDPAddr) {}
+
+func (h *echoHandler) OnReadedAddrPort(data []byte, addr netip.AddrPort, w Writer) {
+	if _, err := w.WriteToAddrPort(data, addr); err != nil {
+		h.OnError(err)
+	}
+}
+
+func (h *echoHandler) OnError(err error) {
+	select {
+	case h.errC <- err:
+	default:
+	}
+}
+
+// startServer starts a server on a loopback port picked by the kernel and
+// shuts it down at the end of the test.
+func startServer(t *testing.T, handler EventHandler, config Config) *Server {
+	t.Helper()
+	return startServerOn(t, "udp4", "127.0.0.1:0", handler, config)
+}
+
+// startServerOn is startServer listening on addr.
+func startServerOn(t *testing.T, network, addr string, handler EventHandler, config Config) *Server {
+	t.Helper()
+	svr, err := NewUDPServer(network, addr, handler, config)
+	if err != nil {
+		t.Fatalf("NewUDPServer: %v", err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := svr.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	})
+	return svr
+}
+
+// dialServer returns a socket connected to the first listener of svr.
+func dialServer(t *testing.T, svr *Server) *net.UDPConn {
+	t.Helper()
+	conn, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(svr.Listeners()[0].Addr()))
+	if err != nil {
+		t.Fatalf("DialUDP: %v", err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// roundTrip writes data to conn and returns the reply.
+func roundTrip(t *testing.T, conn *net.UDPConn, data []byte) []byte {
+	t.Helper()
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	buf := make([]byte, MaxMTU)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	return buf[:n]
+}
+
+// listenPeer returns a socket on a loopback port picked by the kernel, it plays
+// the peer the server writes to.
+func listenPeer(t *testing.T) *net.UDPConn {
+	t.Helper()
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+
+	t.Cleanup(func() { peer.Close() })
+	return peer
+}
+
+// readPeer reads datagrams from peer until n arrived or none came for a while.
+func readPeer(t *testing.T, peer *net.UDPConn, n int) []string {
+	t.Helper()
+	var datagrams []string
+	buf := make([]byte, MaxMTU)
+	for len(datagrams) < n {
+		peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+		m, err := peer.Read(buf)
+		if err != nil {
+			break
+		}
+		datagrams = append(datagrams, string(buf[:m]))
+	}
+
+	return datagrams
+}
+
+func TestServerEcho(t *testing.T) {
+	config := DefaultConfig()
+	config.ReadBatchSize = 8
+	config.WriteBatchSize = 8
+	svr := startServer(t, newEchoHandler(), config)
+	conn := dialServer(t, svr)
+
+	for _, msg := range []string{"a", "hello", string(make([]byte, DefaultMTU))} {
+		if got := roundTrip(t, conn, []byte(msg)); string(got) != msg {
+			t.Fatalf("echo of %d bytes = %d bytes", len(msg), len(got))
+		}
+	}
+}
+
+func TestServerInvalidConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.MTU = MaxMTU + 1
+	if svr, err := NewUDPServer("udp4", "127.0.0.1:0", newEchoHandler(), config); err == nil {
+		svr.Shutdown(context.Background())
+		t.Fatal("NewUDPServer with an invalid Config succeeded")
+	}
+}
+
+func TestServerShutdownTwice(t *testing.T) {
+	svr, err := NewUDPServer("udp4", "127.0.0.1:0", newEchoHandler(), DefaultConfig())
+	if err != nil {
+		t.Fatalf("NewUDPServer: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := svr.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Shutdown %d: %v", i, err)
+		}
+	}
+}
+
+func TestServerServe(t *testing.T) {
+	svr := startServer(t, newEchoHandler(), DefaultConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	errC := make(chan error, 1)
+	go func() { errC <- svr.Serve(ctx) }()
+
+	conn := dialServer(t, svr)
+	if got := roundTrip(t, conn, []byte("ping")); string(got) != "ping" {
+		t.Fatalf("echo = %q, want %q", got, "ping")
+	}
+
+	cancel()
+	select {
+	case err := <-errC:
+		if err != nil {
+			t.Fatalf("Serve: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return once ctx was done")
+	}
+
+	peer := listenPeer(t)
+	if _, err := svr.WriteTo([]byte("late"), peer.LocalAddr().(*net.UDPAddr)); err == nil {
+		t.Fatal("WriteTo after Serve returned succeeded")
+	}
+}
+
+func TestServerWriteBatch(t *testing.T) {
+	svr := startServer(t, newEchoHandler(), DefaultConfig())
+	peer := listenPeer(t)
+	addr := peer.LocalAddr().(*net.UDPAddr)
+
+	msgs := []Message{
+		{AddrPort: addr.AddrPort(), Data: []byte("a")},
+		{Data: []byte("no address")},
+		{Addr: addr, Data: []byte("b")},
+		{AddrPort: addr.AddrPort(), Data: []byte("c")},
+	}
+	done := 0
+	for i := range msgs {
+		msgs[i].Done = func() { done++ }
+	}
+
+	n, err := svr.WriteBatch(msgs)
+	if n != 3 || err == nil {
+		t.Fatalf("WriteBatch() = %d, %v, want 3 and the error of the message without address", n, err)
+	}
+
+	for i, msg := range msgs {
+		failed := i == 1
+		if (msg.Status == WriteFailed) != failed || (msg.Err != nil) != failed {
+			t.Fatalf("message %d: status %v, err %v", i, msg.Status, msg.Err)
+		}
+	}
+
+	if done != 3 {
+		t.Fatalf("Done called %d times, want 3", done)
+	}
+
+	want := []string{"a", "b", "c"}
+	got := readPeer(t, peer, len(want))
+	if len(got) != len(want) {
+		t.Fatalf("peer received %q, want %q", got, want)
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("peer received %q, want %q", got, want)
+		}
+	}
+}
+
+// readedHandler reports the read callback which got every datagram and the
+// peer it got.
+type readedHandler struct {
+	calls chan string
+}
+
+func (h *readedHandler) OnError(err error) {}
+
+func (h *readedHandler) OnReaded(data []byte, addr *net.UDPAddr) {
+	h.calls <- "OnReaded " + addr.String()
+}
+
+type withHandler struct {
+	readedHandler
+}
+
+func (h *withHandler) OnReadedWith(data []byte, addr *net.UDPAddr, w Writer) {
+	h.calls <- "OnReadedWith " + addr.String()
+}
+
+type addrPortHandler struct {
+	withHandler
+}
+
+func (h *addrPortHandler) OnReadedAddrPort(data []byte, addr netip.AddrPort, w Writer) {
+	h.calls <- "OnReadedAddrPort " + addr.String()
+}
+
+func TestServerReadCallbacks(t *testing.T) {
+	calls := make(chan string, 1)
+	tests := []struct {
+		name     string
+		handler  EventHandler
+		callback string
+	}{
+		{"EventHandler", &readedHandler{calls}, "OnReaded"},
+		{"WriterEventHandler", &withHandler{readedHandler{calls}}, "OnReadedWith"},
+		{"AddrPortEventHandler", &addrPortHandler{withHandler{readedHandler{calls}}}, "OnReadedAddrPort"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svr := startServer(t, tt.handler, DefaultConfig())
+			conn := dialServer(t, svr)
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+
+			want := tt.callback + " " + conn.LocalAddr().String()
+			select {
+			case call := <-calls:
+				if call != want {
+					t.Fatalf("got %q, want %q", call, want)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("no read callback was called")
+			}
+		})
+	}
+}
+
+// listenerHandler echoes every datagram and reports the listener which read it.
+type listenerHandler struct {
+	echoHandler
+	listeners chan *Listener
+}
+
+func (h *listenerHandler) OnReadedAddrPort(data []byte, addr netip.AddrPort, w Writer) {
+	h.listeners <- w.Listener()
+	h.echoHandler.OnReadedAddrPort(data, addr, w)
+}
+
+func TestServerAddRemoveListener(t *testing.T) {
+	h := &listenerHandler{echoHandler: *newEchoHandler(), listeners: make(chan *Listener, 1)}
+	svr := startServer(t, h, DefaultConfig())
+	first := svr.Listeners()[0]
+	ln, err := svr.AddListener("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("AddListener: %v", err)
+	}
+
+	if listeners := svr.Listeners(); len(listeners) != 2 || listeners[0] != first || listeners[1] != ln {
+		t.Fatalf("Listeners() = %v, want %v and %v", listeners, first, ln)
+	}
+
+	conns := make(map[*Listener]*net.UDPConn)
+	for _, l := range []*Listener{first, ln} {
+		conn, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(l.Addr()))
+		if err != nil {
+			t.Fatalf("DialUDP: %v", err)
+		}
+		defer conn.Close()
+		conns[l] = conn
+
+		if got := roundTrip(t, conn, []byte("ping")); string(got) != "ping" {
+			t.Fatalf("echo from %v = %q, want %q", l, got, "ping")
+		}
+
+		if got := <-h.listeners; got != l {
+			t.Fatalf("datagram to %v read by %v", l, got)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := svr.RemoveListener(ctx, ln); err != nil {
+		t.Fatalf("RemoveListener: %v", err)
+	}
+
+	if listeners := svr.Listeners(); len(listeners) != 1 || listeners[0] != first {
+		t.Fatalf("Listeners() after RemoveListener = %v, want %v", listeners, first)
+	}
+
+	if _, err := ln.WriteToAddrPort([]byte("late"), first.Addr()); err == nil {
+		t.Fatal("WriteToAddrPort from a removed listener succeeded")
+	}
+
+	// the other listener keeps serving
+	if got := roundTrip(t, conns[first], []byte("pong")); string(got) != "pong" {
+		t.Fatalf("echo after RemoveListener = %q, want %q", got, "pong")
+	}
+	<-h.listeners
+
+	other := startServer(t, newEchoHandler(), DefaultConfig())
+	if err := svr.RemoveListener(ctx, other.Listeners()[0]); err == nil {
+		t.Fatal("RemoveListener of another server's listener succeeded")
+	}
+}
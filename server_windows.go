@@ -1,8 +1,10 @@
 package fastudp
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 
@@ -10,82 +12,317 @@ import (
 )
 
 type Server struct {
-	wg      sync.WaitGroup
-	handler EventHandler
-	conn    *net.UDPConn
-	err     error
-	closed  atomic.Value
+	wg         sync.WaitGroup // running readers
+	handler    EventHandler
+	handlers   *handlers
+	dispatcher *dispatcher  // nil for DispatchInline
+	listeners  atomic.Value // []*Listener, replaced as a whole under the lock
+	readers    int
+	err        error
+	closed     atomic.Value
+	config     Config
+	done       chan struct{} // closed when the last reader has exited
+	packetPool sync.Pool
+	sync.Mutex
 }
 
-func NewUDPServer(network, addr string, mtu int, handler EventHandler) (*Server, error) {
-	if !netudp.IsUDP(network) {
-		return nil, fmt.Errorf("unknown network: %v", network)
+// NewUDPServer listens on addr, only config.MTU and config.Dispatch are used on windows.
+// More addresses can be served by the same server with AddListener.
+func NewUDPServer(network, addr string, handler EventHandler, config Config) (*Server, error) {
+	svr, err := newServer(handler, config)
+	if err != nil {
+		return nil, err
 	}
 
-	svr := &Server{
-		handler: handler,
+	if _, err := svr.AddListener(network, addr); err != nil {
+		svr.Shutdown(context.Background())
+		return nil, err
 	}
 
-	if err := svr.start(network, addr, mtu); err != nil {
+	return svr, nil
+}
+
+func newServer(handler EventHandler, config Config) (*Server, error) {
+	if err := config.validate(); err != nil {
 		return nil, err
 	}
 
+	svr := &Server{
+		handler: handler,
+		config:  config,
+		done:    make(chan struct{}),
+	}
+	svr.packetPool.New = func() interface{} {
+		return &Packet{}
+	}
+	svr.handlers = newHandlers(handler)
+	if svr.config.Dispatch.Mode != DispatchInline {
+		svr.dispatcher = newDispatcher(svr.handlers, &svr.config.Dispatch)
+	}
+
+	svr.listeners.Store([]*Listener(nil))
 	svr.closed.Store(false)
 	return svr, nil
 }
 
-func (svr *Server) start(network, addr string, mtu int) error {
-	udpAddr, err := net.ResolveUDPAddr(network, addr)
-	if err != nil {
-		return fmt.Errorf("resolve addr: %v", err)
+// AddListener listens on addr with a reader of its own, it can be called while
+// the server is running.
+func (svr *Server) AddListener(network, addr string) (*Listener, error) {
+	if !netudp.IsUDP(network) {
+		return nil, fmt.Errorf("unknown network: %v", network)
 	}
 
-	conn, err := net.ListenUDP(network, udpAddr)
+	conn, err := netudp.ListenUDP(network, addr, svr.config.Socket)
 	if err != nil {
-		return fmt.Errorf("listen udp: %v", err)
+		return nil, fmt.Errorf("listen udp: %v", err)
 	}
 
-	svr.conn = conn
+	ln := newListener(svr, network, conn)
+	if err = ln.readSocketOptions(); err != nil {
+		conn.Close()
+		return nil, err
+	}
 
+	if err := svr.serve(ln); err != nil {
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+// RemoveListener closes the socket of ln and waits for its reader until ctx is
+// done. Other listeners keep running.
+func (svr *Server) RemoveListener(ctx context.Context, ln *Listener) error {
+	if ln == nil || ln.svr != svr {
+		return fmt.Errorf("listener not found")
+	}
+
+	svr.Lock()
+	svr.removeListener(ln)
+	svr.Unlock()
+	ln.conn.Close()
+
+	select {
+	case <-ln.done:
+	case <-ctx.Done():
+	}
+
+	return ctx.Err()
+}
+
+// Listeners returns the listeners of the server in the order they were added.
+func (svr *Server) Listeners() []*Listener {
+	listeners := svr.listeners.Load().([]*Listener)
+	return append([]*Listener(nil), listeners...)
+}
+
+// serve starts the reader of ln, the socket of ln is closed when it fails.
+func (svr *Server) serve(ln *Listener) error {
+	svr.Lock()
+	defer svr.Unlock()
+
+	if svr.IsClosed() {
+		ln.conn.Close()
+		return fmt.Errorf("server closed")
+	}
+
+	listeners := svr.listeners.Load().([]*Listener)
+	svr.listeners.Store(append(listeners[:len(listeners):len(listeners)], ln))
+	svr.readers++
 	svr.wg.Add(1)
-	go func() {
-		defer svr.wg.Done()
+	go ln.read()
+	return nil
+}
 
-		buffer := make([]byte, mtu)
-		for {
-			n, remoteAddr, err := conn.ReadFrom(buffer)
-			if err != nil {
-				return
-			}
+// removeListener must be called with the lock held.
+func (svr *Server) removeListener(ln *Listener) {
+	ln.removed.Store(true)
 
-			if n > 0 {
-				svr.handler.OnReaded(buffer[:n], remoteAddr.(*net.UDPAddr))
-			}
+	listeners := svr.listeners.Load().([]*Listener)
+	for i, l := range listeners {
+		if l == ln {
+			rest := make([]*Listener, 0, len(listeners)-1)
+			rest = append(rest, listeners[:i]...)
+			svr.listeners.Store(append(rest, listeners[i+1:]...))
+			return
+		}
+	}
+}
+
+func (svr *Server) readFailed(err error) {
+	svr.Lock()
+	if svr.err == nil {
+		svr.err = err
+	}
+	svr.Unlock()
+
+	svr.handler.OnError(err)
+}
+
+func (svr *Server) listenerClosed(ln *Listener) {
+	svr.Lock()
+	defer svr.Unlock()
+
+	svr.removeListener(ln)
+	close(ln.done)
+	svr.readers--
+	svr.wg.Done()
 
+	// removing the last listener doesn't stop the server, failing does
+	if svr.readers == 0 && (svr.err != nil || svr.IsClosed()) {
+		select {
+		case <-svr.done:
+		default:
+			close(svr.done)
 		}
+	}
+}
+
+// Shutdown closes the sockets and waits for the readers until ctx is done,
+// writes are never queued on windows so there is nothing to flush.
+func (svr *Server) Shutdown(ctx context.Context) error {
+	svr.Lock()
+	if !svr.closed.CompareAndSwap(false, true) {
+		svr.Unlock()
+		return nil
+	}
+
+	listeners := svr.listeners.Load().([]*Listener)
+	svr.Unlock()
+
+	for _, ln := range listeners {
+		ln.conn.Close()
+	}
+
+	waitC := make(chan struct{})
+	go func() {
+		svr.wg.Wait()
+		// no reader dispatches anymore, let the workers finish
+		if svr.dispatcher != nil {
+			svr.dispatcher.close()
+		}
+		close(waitC)
 	}()
 
-	return nil
+	select {
+	case <-waitC:
+	case <-ctx.Done():
+	}
+
+	return ctx.Err()
 }
 
-func (svr *Server) Shutdown(err error) {
-	if svr.IsClosed() {
-		return
+// Stats returns a snapshot of the server counters.
+func (svr *Server) Stats() Stats {
+	stats := Stats{}
+	if svr.dispatcher != nil {
+		stats.Dispatch = svr.dispatcher.stats()
 	}
 
-	svr.conn.Close()
-	svr.wg.Wait()
-	svr.closed.Store(true)
+	return stats
+}
+
+// PathMTU isn't supported on windows.
+func (svr *Server) PathMTU(addr netip.AddrPort) (int, error) {
+	return 0, fmt.Errorf("path MTU not supported on windows")
+}
+
+// Serve blocks until ctx is done or every reader has exited, then shuts the
+// server down within Config.ShutdownTimeout.
+func (svr *Server) Serve(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+	case <-svr.done:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), svr.config.ShutdownTimeout)
+	defer cancel()
+
+	err := svr.Shutdown(shutdownCtx)
+
+	svr.Lock()
+	defer svr.Unlock()
+	if svr.err != nil {
+		return svr.err
+	}
+
+	return err
 }
 
 func (svr *Server) IsClosed() bool {
 	return svr.closed.Load().(bool)
 }
 
-func (svr *Server) WriteTo(addr *net.UDPAddr, data []byte) (int, error) {
-	if svr.closed.Load().(bool) {
-		return 0, fmt.Errorf("server is closed")
+// listener returns the listener writes of the server are sent from.
+func (svr *Server) listener() (*Listener, error) {
+	if svr.IsClosed() {
+		return nil, fmt.Errorf("server is closed")
+	}
+
+	listeners := svr.listeners.Load().([]*Listener)
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("not found valid listener")
+	}
+
+	return listeners[0], nil
+}
+
+// WriteTo sends data to addr from the first listener.
+func (svr *Server) WriteTo(data []byte, addr *net.UDPAddr) (int, error) {
+	ln, err := svr.listener()
+	if err != nil {
+		return 0, err
+	}
+
+	return ln.WriteTo(data, addr)
+}
+
+func (svr *Server) WriteToAddrPort(data []byte, addr netip.AddrPort) (int, error) {
+	ln, err := svr.listener()
+	if err != nil {
+		return 0, err
+	}
+
+	return ln.WriteToAddrPort(data, addr)
+}
+
+// WriteMsgTo is WriteToAddrPort, src and ifIndex are ignored on windows.
+func (svr *Server) WriteMsgTo(data []byte, addr netip.AddrPort, src netip.Addr, ifIndex int) (int, error) {
+	return svr.WriteToAddrPort(data, addr)
+}
+
+// WriteMsg sends msg to its address, its other options are ignored on windows.
+func (svr *Server) WriteMsg(msg *Message) (int, error) {
+	n, err := svr.WriteToAddrPort(msg.Data, msg.addrPort())
+	if err == nil {
+		msg.sent()
+	}
+
+	return n, err
+}
+
+// WriteBatch writes msgs one by one, there is no sendmmsg on windows.
+func (svr *Server) WriteBatch(msgs []Message) (int, error) {
+	return writeBatch(msgs, svr.WriteToAddrPort)
+}
+
+func writeBatch(msgs []Message, writeTo func([]byte, netip.AddrPort) (int, error)) (int, error) {
+	var firstErr error
+	accepted := 0
+	for i := range msgs {
+		if _, err := writeTo(msgs[i].Data, msgs[i].addrPort()); err != nil {
+			msgs[i].fail(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		msgs[i].Status = WriteSent
+		msgs[i].Err = nil
+		msgs[i].sent()
+		accepted++
 	}
 
-	return svr.conn.WriteTo(data, addr)
+	return accepted, firstErr
 }
@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+package fastudp
+
+import (
+	"net/netip"
+
+	"github.com/shaoyuan1943/fastudp/netudp"
+	"golang.org/x/sys/unix"
+)
+
+type socket struct {
+	addr    unix.Sockaddr
+	fd      int
+	network string
+	local   netip.AddrPort       // bound address, the port is the one picked by the kernel for port 0
+	remote  netip.AddrPort       // peer of a connected socket
+	opts    netudp.SocketOptions // as applied by the kernel
+}
+
+func listen(network, addr string, opts netudp.SocketOptions) (*socket, error) {
+	sock := &socket{}
+	fd, sockaddr, err := netudp.NewUDPSocket(network, addr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sock.fd = fd
+	sock.addr = sockaddr
+	sock.network = network
+	sock.local = sock.localAddr()
+	if sock.opts, err = netudp.ReadSocketOptions(netudp.NewRawConn(fd)); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	return sock, nil
+}
+
+func dial(network, addr string, opts netudp.SocketOptions) (*socket, error) {
+	sock := &socket{}
+	fd, remote, err := netudp.NewConnectedUDPSocket(network, addr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sock.fd = fd
+	sock.addr, _ = unix.Getsockname(fd)
+	sock.network = network
+	sock.local = sock.localAddr()
+	sock.remote = remote
+	if sock.opts, err = netudp.ReadSocketOptions(netudp.NewRawConn(fd)); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	return sock, nil
+}
+
+func (sock *socket) localAddr() netip.AddrPort {
+	sa, err := unix.Getsockname(sock.fd)
+	if err != nil {
+		return netip.AddrPort{}
+	}
+
+	return netudp.SockaddrToAddrPort(sa)
+}
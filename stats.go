@@ -0,0 +1,25 @@
+package fastudp
+
+import "net/netip"
+
+// Stats is a snapshot of the counters of a server.
+type Stats struct {
+	Dispatch DispatchStats
+	// Drops is the number of datagrams the kernel dropped because a receive queue
+	// was full, over all the event-loops which ever ran. It needs
+	// Config.Socket.RecvDrops.
+	Drops uint64
+	// Loops holds the counters of the running event-loops.
+	Loops []LoopStats
+}
+
+// LoopStats is a snapshot of the counters of an event-loop.
+type LoopStats struct {
+	// Addr is the address of the listener of the event-loop.
+	Addr netip.AddrPort
+	// Drops is the number of datagrams the kernel dropped on the socket of the
+	// event-loop, it needs Config.Socket.RecvDrops.
+	Drops uint64
+	// Queued is the number of datagrams waiting in the write queue.
+	Queued int
+}
@@ -0,0 +1,79 @@
+//go:build linux
+// +build linux
+
+package fastudp
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// loopHandler records the event-loop which read the datagrams of every key,
+// the second byte of the payload.
+type loopHandler struct {
+	sync.Mutex
+	loops map[byte]map[*eventLoop]int
+	n     int
+}
+
+func (h *loopHandler) OnReaded([]byte, *net.UDPAddr) {}
+func (h *loopHandler) OnError(err error)             {}
+
+func (h *loopHandler) OnReadedAddrPort(data []byte, addr netip.AddrPort, w Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	key := data[1]
+	if h.loops[key] == nil {
+		h.loops[key] = make(map[*eventLoop]int)
+	}
+	h.loops[key][w.(*eventLoop)]++
+	h.n++
+}
+
+func TestServerSteerByPayload(t *testing.T) {
+	config := DefaultConfig()
+	config.ListenerN = 2
+	config.Socket.ReusePort = true
+	config.Steering = SteeringConfig{Policy: SteerByPayload, PayloadOffset: 1, PayloadSize: 1}
+	h := &loopHandler{loops: make(map[byte]map[*eventLoop]int)}
+	svr := startServer(t, h, config)
+	conn := dialServer(t, svr)
+
+	const n = 64
+	for i := 0; i < n; i++ {
+		if _, err := conn.Write([]byte{'x', byte(i % 2)}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		h.Lock()
+		done := h.n == n
+		h.Unlock()
+		if done {
+			break
+		}
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	if h.n != n {
+		t.Fatalf("handled %d of %d datagrams", h.n, n)
+	}
+
+	// every key sticks to one event-loop from the first datagram on
+	if len(h.loops[0]) != 1 || len(h.loops[1]) != 1 {
+		t.Fatalf("keys were read by %d and %d event-loops, want 1 each", len(h.loops[0]), len(h.loops[1]))
+	}
+
+	for loop := range h.loops[0] {
+		if h.loops[1][loop] != 0 {
+			t.Fatal("both keys were read by the same event-loop")
+		}
+	}
+}